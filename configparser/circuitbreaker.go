@@ -0,0 +1,29 @@
+package configparser
+
+import (
+	"errors"
+)
+
+// CircuitBreakerConfig skips an execution for a while once it failed too many
+// times in a row, instead of waiting for it to fail again at every scrape
+type CircuitBreakerConfig struct {
+	// All fields below must be exported (start with a capital letter)
+	// so that the yaml.UnmarshalStrict() method can set them.
+
+	// The number of consecutive failures opening the circuit
+	Failures uint
+	// The duration in milliseconds during which the execution is skipped once
+	// the circuit is open, after which it is tried again
+	OpenDuration uint `yaml:"openDuration"`
+}
+
+// verifyCircuitBreakerConfig makes sure the circuit breaker of an execution is complete
+func verifyCircuitBreakerConfig(breaker *CircuitBreakerConfig, location string) error {
+	if breaker.Failures == 0 {
+		return errors.New("Missing field 'failures' in 'circuitBreaker' of " + location)
+	}
+	if breaker.OpenDuration == 0 {
+		return errors.New("Missing field 'openDuration' in 'circuitBreaker' of " + location)
+	}
+	return nil
+}
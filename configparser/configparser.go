@@ -3,22 +3,59 @@ package configparser
 import (
 	"errors"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/prometheus/exporter-toolkit/web"
 	yaml "gopkg.in/yaml.v2"
 )
 
 const (
-	defaultEndpoint      = "/metrics"
-	defaultTimeout  uint = 1000
-	defaultExecutionType = "bash"
+	defaultEndpoint           = "/metrics"
+	defaultTimeout       uint = 1000
+	defaultExecutionType      = "bash"
+	defaultOpenMetrics        = true
+	defaultValueFrom          = "stdout"
+	defaultTimestampFrom      = "scrape"
+)
+
+var (
+	supportedMetricTypes      = []string{"gauge", "counter"}
+	supportedShells           = []string{"sh", "bash", "tcsh", "zsh"}
+	supportedExecutionTypes   = append(supportedShells, expressionExecutionType)
+	supportedValueSources     = []string{"stdout", "exitCode", "duration", "outputLines", "outputBytes"}
+	supportedTimestampSources = []string{"scrape", "output"}
+
+	// The endpoints served by the main webserver, which cannot be used by an
+	// exporter that shares the main address
+	mainEndpoints = []string{"/", "/reload", "/-/reload", "/-/metrics", "/validate"}
+
+	// See https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+	metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// The prefix of the metrics produced by the custom-prometheus-exporter itself
+	reservedMetricPrefix = "custom_exporter_"
 )
 
 // Config is the structure that holds the configuration of the custom-prometheus-exporter
 type Config struct {
-	// The port used by the main webserver and possibly by some exporters
-	MainPort int
+	// The address of the main webserver, which is also used by the exporters
+	// not specifying their own port or address.  Either [host]:port or unix:<path>
+	MainListenAddress string
+
+	// The web configuration file enabling TLS and basic authentication on the
+	// main webserver, and by default on every exporter
+	WebConfigFile string
+
+	// Subtracted from the scrape timeout given by the scraper, to leave
+	// some time to send the response before the scraper gives up
+	ScrapeTimeoutOffset time.Duration
 
 	// The path of each configuration file defining the exporters
 	ConfigFiles []string
@@ -28,15 +65,42 @@ type Config struct {
 	Exporters []ExporterConfig
 }
 
+// FileValidation holds the result of the validation of a single configuration file
+type FileValidation struct {
+	File  string
+	Error error
+}
+
 // ExporterConfig is the structure that contains the information about each defined
 // exporter that will be instantiated
 type ExporterConfig struct {
 	// All fields below must be exported (start with a capital letter)
 	// so that the yaml.UnmarshalStrict() method can set them.
-	Name     string
-	Port     int
-	Endpoint string
-	Metrics  []MetricsConfig
+	Name string
+	Port int
+	// Either [host]:port or unix:<path>.  Set from 'port' or from the address of
+	// the main webserver if omitted.
+	ListenAddress string `yaml:"listenAddress"`
+	Endpoint      string
+	// The web configuration file enabling TLS and basic authentication on the
+	// port of this exporter, relative to the directory of the configuration file
+	WebConfigFile string `yaml:"webConfigFile"`
+	// Serve the OpenMetrics format to the scrapers requesting it.
+	// A pointer so we can check for nil (missing).
+	OpenMetrics *bool `yaml:"openMetrics"`
+	// Add the _created samples of the counters to the OpenMetrics format
+	CreatedTimestamps bool `yaml:"createdTimestamps"`
+	// In milliseconds.  The scrapes happening within this duration after a
+	// collection reuse its results instead of running the commands again.
+	MinInterval uint `yaml:"minInterval"`
+	// Render the help, the label values and the commands of the metrics as
+	// templates when parsing the configuration.  Always enabled for probes,
+	// whose templates are rendered for each scrape, and for the metrics with a 'foreach'.
+	Templates bool
+	// If present, the exporter is a probe whose commands are templates
+	// using the target and the parameters given by each scrape
+	Probe   *ProbeConfig
+	Metrics []MetricsConfig
 }
 
 // MetricsConfig is the structure that contains the information about each metric
@@ -46,12 +110,62 @@ type MetricsConfig struct {
 	Name       string
 	Help       string
 	MetricType string `yaml:"type"`
-	Executions []struct {
-		ExecutionType string `yaml:"type"`
-		Command       string
-		Timeout       *uint // A pointer so we can check for nil (missing)
-		Labels        map[string]string
+	// Generates the executions for each item of a list
+	Foreach *ForeachConfig
+	// The defaults of the cache of the executions of the metric
+	CacheTTL             *uint `yaml:"cacheTTL"`
+	StaleWhileRevalidate *bool `yaml:"staleWhileRevalidate"`
+	Executions           []ExecutionConfig
+}
+
+// ExecutionConfig is the structure that contains the information about each
+// execution used to generate the value of a metric
+type ExecutionConfig struct {
+	// All fields below must be exported (start with a capital letter)
+	// so that the yaml.UnmarshalStrict() method can set them.
+	ExecutionType string `yaml:"type"`
+	// Identifies the execution, so that expressions can use its value
+	ID string
+	// The command run by the shell, or the expression computing the value
+	// of an execution of type 'expression'
+	Command string
+	Timeout *uint // A pointer so we can check for nil (missing)
+	Labels  map[string]string
+	// What gives the value of the metric: the output of the command, its exit
+	// code, its duration in seconds, or the number of lines or bytes of its output
+	ValueFrom string `yaml:"valueFrom"`
+	// Maps the output of the command, once trimmed, to the value of the metric
+	ValueMap map[string]float64 `yaml:"valueMap"`
+	// The value of the metric when the output is not in the value map.
+	// A pointer so we can check for nil (missing).
+	DefaultValue *float64 `yaml:"defaultValue"`
+	// Converts the value, e.g., to the base unit required by the Prometheus
+	// naming conventions
+	Transform *TransformConfig
+	// What gives the timestamp of the samples: the time of the scrape, or the
+	// last word of the output of the command, after the value
+	TimestampFrom string `yaml:"timestampFrom"`
+	// The result of the execution is reused by the scrapes for this duration in
+	// milliseconds, which defaults to the one of the metric.  0 means no cache.
+	CacheTTL *uint `yaml:"cacheTTL"`
+	// Serves the expired result while the execution is run again in the background,
+	// instead of waiting for it.  Defaults to the one of the metric.
+	StaleWhileRevalidate *bool `yaml:"staleWhileRevalidate"`
+	// The number of times a failed execution is run again during a scrape
+	Retries uint
+	// The delay in milliseconds before the first retry, doubled for each next retry
+	RetryDelay uint `yaml:"retryDelay"`
+	// Skips the execution for a while once it failed too many times in a row
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker"`
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
+	return false
 }
 
 func (c *Config) verifyExporterConfig(exporter *ExporterConfig) error {
@@ -60,15 +174,34 @@ func (c *Config) verifyExporterConfig(exporter *ExporterConfig) error {
 		return errors.New("Missing field 'name' in top configuration")
 	}
 
-	// If 'port' is absent, use the MainPort
-	if exporter.Port == 0 {
-		exporter.Port = c.MainPort
+	// 'port' is a shortcut for listening on all interfaces
+	if exporter.Port != 0 {
+		if exporter.ListenAddress != "" {
+			return errors.New("Fields 'port' and 'listenAddress' cannot be used together in top configuration")
+		}
+		exporter.ListenAddress = net.JoinHostPort("", strconv.Itoa(exporter.Port))
+	}
+
+	// If both 'port' and 'listenAddress' are absent, use the address of the main webserver
+	if exporter.ListenAddress == "" {
+		exporter.ListenAddress = c.MainListenAddress
+	} else if err := verifyListenAddress(exporter.ListenAddress); err != nil {
+		return err
+	}
+
+	// The main address is served with the web configuration of the main webserver
+	if exporter.WebConfigFile == "" {
+		exporter.WebConfigFile = c.WebConfigFile
+	} else if exporter.ListenAddress == c.MainListenAddress {
+		return errors.New("Field 'webConfigFile' cannot be used by an exporter using the main address " +
+			c.MainListenAddress)
+	} else if err := web.Validate(exporter.WebConfigFile); err != nil {
+		return errors.New("Invalid web configuration file '" + exporter.WebConfigFile + "': " + err.Error())
 	}
 
 	// If 'endpoint' is absent, use the the default endpoint
 	if exporter.Endpoint == "" {
 		exporter.Endpoint = defaultEndpoint
-		return nil
 	}
 
 	// Add '/' at the start of 'endpoint' if it is missing
@@ -76,49 +209,151 @@ func (c *Config) verifyExporterConfig(exporter *ExporterConfig) error {
 		exporter.Endpoint = strings.Join([]string{"/", exporter.Endpoint}, "")
 	}
 
+	// If 'openMetrics' is absent, serve OpenMetrics to the scrapers requesting it
+	if exporter.OpenMetrics == nil {
+		openMetrics := defaultOpenMetrics
+		exporter.OpenMetrics = &openMetrics
+	}
+
 	// Make sure 'metrics' is present
 	if len(exporter.Metrics) == 0 {
 		return errors.New("Missing field 'metrics' in top configuration")
 	}
 
+	for i := range exporter.Metrics {
+		if exporter.Metrics[i].Foreach != nil {
+			if err := verifyForeachConfig(&exporter.Metrics[i], i); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The templates of a probe are rendered for each scrape, once its target is known
+	if exporter.Probe == nil {
+		metrics, err := renderMetrics(exporter.Metrics, newTemplateData(exporter, "", nil), exporter.Templates)
+		if err != nil {
+			return err
+		}
+		exporter.Metrics = metrics
+	}
+
 	for i, metric := range exporter.Metrics {
 		if metric.Name == "" {
-			return errors.New("Missing field 'name' in 'metrics' configuration of metric " + string(i))
+			return errors.New("Missing field 'name' in 'metrics' configuration of metric " + strconv.Itoa(i))
 		}
 
 		if metric.Help == "" {
-			return errors.New("Missing field 'help' in 'metrics' configuration of metric " + string(i))
+			return errors.New("Missing field 'help' in 'metrics' configuration of metric " + strconv.Itoa(i))
 		}
 
 		if metric.MetricType == "" {
-			return errors.New("Missing field 'type' in 'metrics' configuration of metric " + string(i))
+			return errors.New("Missing field 'type' in 'metrics' configuration of metric " + strconv.Itoa(i))
+		}
+
+		if !contains(supportedMetricTypes, metric.MetricType) {
+			return errors.New("Wrong value for field 'type' in 'metrics' configuration of metric " + strconv.Itoa(i) +
+				". Supported values are: gauge or counter")
 		}
 
-		if metric.MetricType != "gauge" {
-			return errors.New("Wrong value for field 'type' in 'metrics' configuration of metric " + string(i) +
-				". Supported values are: gauge")
+		if !metricNameRegexp.MatchString(metric.Name) {
+			return errors.New("Wrong value for field 'name' in 'metrics' configuration of metric " + strconv.Itoa(i) +
+				". '" + metric.Name + "' is not a valid Prometheus metric name")
+		}
+
+		if strings.HasPrefix(metric.Name, reservedMetricPrefix) {
+			return errors.New("Wrong value for field 'name' in 'metrics' configuration of metric " + strconv.Itoa(i) +
+				". The prefix '" + reservedMetricPrefix + "' is reserved for the metrics of the Custom Prometheus Exporter")
+		}
+
+		// The OpenMetrics format requires the suffix, which would otherwise be added to
+		// the name of the samples, making them different from the Prometheus text format
+		if metric.MetricType == "counter" && !strings.HasSuffix(metric.Name, "_total") {
+			return errors.New("Wrong value for field 'name' in 'metrics' configuration of metric " + strconv.Itoa(i) +
+				". The name of a counter must end with '_total'")
+		}
+
+		for k := 0; k < i; k++ {
+			if exporter.Metrics[k].Name == metric.Name {
+				return errors.New("Duplicate metric name '" + metric.Name + "' in 'metrics' configuration of metric " +
+					strconv.Itoa(i))
+			}
 		}
 
 		// Make sure 'executions' is present
 		if len(metric.Executions) == 0 {
-			return errors.New("Missing field 'executions' in 'metrics' configuration of metric " + string(i))
+			return errors.New("Missing field 'executions' in 'metrics' configuration of metric " + strconv.Itoa(i))
 		}
 
 		for j, execution := range metric.Executions {
 			// ExecutionType defaults to the bash shell
 			if execution.ExecutionType == "" {
+				execution.ExecutionType = defaultExecutionType
 				exporter.Metrics[i].Executions[j].ExecutionType = defaultExecutionType
 			}
 
-			if execution.ExecutionType != "sh" && execution.ExecutionType != "bash" &&
-				execution.ExecutionType != "tcsh" && execution.ExecutionType != "zsh" {
-				return errors.New("Wrong value for field 'type' in 'executions' configuration of metric " + string(i) +
-					" and execution " + string(j) + ". Supported values are: sh, bash, tcsh or zsh")
+			if !contains(supportedExecutionTypes, execution.ExecutionType) {
+				return errors.New("Wrong value for field 'type' in 'executions' configuration of metric " + strconv.Itoa(i) +
+					" and execution " + strconv.Itoa(j) + ". Supported values are: sh, bash, tcsh, zsh or expression")
 			}
 
 			if execution.Command == "" {
-				return errors.New("Missing field 'command' in 'executions' configuration of metric " + string(i) +
-					" and execution " + string(j))
+				return errors.New("Missing field 'command' in 'executions' configuration of metric " + strconv.Itoa(i) +
+					" and execution " + strconv.Itoa(j))
+			}
+
+			// 'valueFrom' defaults to parsing the output of the command
+			if execution.ValueFrom == "" {
+				execution.ValueFrom = defaultValueFrom
+				exporter.Metrics[i].Executions[j].ValueFrom = defaultValueFrom
+			}
+
+			if !contains(supportedValueSources, execution.ValueFrom) {
+				return errors.New("Wrong value for field 'valueFrom' in 'executions' configuration of metric " + strconv.Itoa(i) +
+					" and execution " + strconv.Itoa(j) + ". Supported values are: stdout, exitCode, duration, outputLines or outputBytes")
+			}
+
+			if len(execution.ValueMap) > 0 && execution.ValueFrom != defaultValueFrom {
+				return errors.New("Field 'valueMap' can only be used with 'valueFrom: stdout' in 'executions' configuration of metric " +
+					strconv.Itoa(i) + " and execution " + strconv.Itoa(j))
+			}
+
+			if execution.DefaultValue != nil && len(execution.ValueMap) == 0 {
+				return errors.New("Field 'defaultValue' requires field 'valueMap' in 'executions' configuration of metric " +
+					strconv.Itoa(i) + " and execution " + strconv.Itoa(j))
+			}
+
+			// 'timestampFrom' defaults to the time of the scrape
+			if execution.TimestampFrom == "" {
+				execution.TimestampFrom = defaultTimestampFrom
+				exporter.Metrics[i].Executions[j].TimestampFrom = defaultTimestampFrom
+			}
+
+			if !contains(supportedTimestampSources, execution.TimestampFrom) {
+				return errors.New("Wrong value for field 'timestampFrom' in 'executions' configuration of metric " + strconv.Itoa(i) +
+					" and execution " + strconv.Itoa(j) + ". Supported values are: scrape or output")
+			}
+
+			if execution.TimestampFrom == "output" && execution.ValueFrom != defaultValueFrom {
+				return errors.New("Field 'timestampFrom: output' can only be used with 'valueFrom: stdout' in 'executions' configuration of metric " +
+					strconv.Itoa(i) + " and execution " + strconv.Itoa(j))
+			}
+
+			if execution.RetryDelay != 0 && execution.Retries == 0 {
+				return errors.New("Field 'retryDelay' requires field 'retries' in 'executions' configuration of metric " +
+					strconv.Itoa(i) + " and execution " + strconv.Itoa(j))
+			}
+
+			if execution.CircuitBreaker != nil {
+				if err := verifyCircuitBreakerConfig(execution.CircuitBreaker, executionLocation{i, j}.String()); err != nil {
+					return err
+				}
+			}
+
+			if execution.Transform != nil {
+				location := executionLocation{i, j}.String()
+				if err := verifyTransformConfig(&execution, location); err != nil {
+					return err
+				}
 			}
 
 			// If 'timeout' was omitted use the default timeout
@@ -128,20 +363,172 @@ func (c *Config) verifyExporterConfig(exporter *ExporterConfig) error {
 				exporter.Metrics[i].Executions[j].Timeout = &defaultT
 			}
 
+			// The cache defaults to the one of the metric, except for the
+			// expressions which are cheap to evaluate
+			if execution.ExecutionType != expressionExecutionType {
+				if execution.CacheTTL == nil {
+					execution.CacheTTL = metric.CacheTTL
+					exporter.Metrics[i].Executions[j].CacheTTL = metric.CacheTTL
+				}
+				if execution.StaleWhileRevalidate == nil {
+					execution.StaleWhileRevalidate = metric.StaleWhileRevalidate
+					exporter.Metrics[i].Executions[j].StaleWhileRevalidate = metric.StaleWhileRevalidate
+				}
+			}
+
+			if execution.StaleWhileRevalidate != nil && *execution.StaleWhileRevalidate &&
+				(execution.CacheTTL == nil || *execution.CacheTTL == 0) {
+				return errors.New("Field 'staleWhileRevalidate' requires field 'cacheTTL' in 'executions' configuration of metric " +
+					strconv.Itoa(i) + " and execution " + strconv.Itoa(j))
+			}
+
 			// Check 'labels'. Can be omitted only if there is a single element
 			// in the 'executions' array, for this metric
 			if len(metric.Executions) > 1 && len(execution.Labels) == 0 {
-				return errors.New("Missing field 'labels' in 'executions' configuration of metric " + string(i) +
-					" and execution " + string(j))
+				return errors.New("Missing field 'labels' in 'executions' configuration of metric " + strconv.Itoa(i) +
+					" and execution " + strconv.Itoa(j))
+			}
+
+			if err := verifyLabels(metric.Executions, j); err != nil {
+				return errors.New(err.Error() + " in 'executions' configuration of metric " + strconv.Itoa(i) +
+					" and execution " + strconv.Itoa(j))
 			}
 		}
 	}
+
+	if err := verifyExpressions(exporter); err != nil {
+		return err
+	}
+
+	if exporter.Probe != nil {
+		return verifyProbeConfig(exporter)
+	}
+	return nil
+}
+
+// verifyLabels checks that the labels of an execution are valid Prometheus labels
+// and that they are consistent with the previous executions of the same metric
+func verifyLabels(executions []ExecutionConfig, index int) error {
+	labels := executions[index].Labels
+	for name := range labels {
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return errors.New("Invalid label name '" + name + "'")
+		}
+	}
+
+	for k := 0; k < index; k++ {
+		previous := executions[k].Labels
+		if len(previous) != len(labels) {
+			return errors.New("Labels differ from the ones of execution " + strconv.Itoa(k))
+		}
+
+		sameValues := true
+		for name, value := range labels {
+			previousValue, ok := previous[name]
+			if !ok {
+				return errors.New("Labels differ from the ones of execution " + strconv.Itoa(k))
+			}
+			if previousValue != value {
+				sameValues = false
+			}
+		}
+		if sameValues {
+			return errors.New("Same label values as execution " + strconv.Itoa(k))
+		}
+	}
+	return nil
+}
+
+// verifyExporterCollision makes sure an exporter can be served alongside the
+// previously defined exporters and the main webserver
+func (c *Config) verifyExporterCollision(exporter *ExporterConfig, previous []ExporterConfig) error {
+	if exporter.ListenAddress == c.MainListenAddress && contains(mainEndpoints, exporter.Endpoint) {
+		return errors.New("Endpoint '" + exporter.Endpoint + "' of exporter '" + exporter.Name +
+			"' is reserved by the main webserver on address " + c.MainListenAddress)
+	}
+
+	if exporter.ListenAddress != c.MainListenAddress && overlappingAddresses(exporter.ListenAddress, c.MainListenAddress) {
+		return errors.New("Address " + exporter.ListenAddress + " of exporter '" + exporter.Name +
+			"' overlaps with the address " + c.MainListenAddress + " of the main webserver")
+	}
+
+	for _, other := range previous {
+		if other.Name == exporter.Name {
+			return errors.New("Duplicate exporter name '" + exporter.Name + "'")
+		}
+
+		if other.ListenAddress != exporter.ListenAddress {
+			if overlappingAddresses(other.ListenAddress, exporter.ListenAddress) {
+				return errors.New("Exporters '" + other.Name + "' and '" + exporter.Name +
+					"' use the overlapping addresses " + other.ListenAddress + " and " + exporter.ListenAddress)
+			}
+			continue
+		}
+
+		if other.Endpoint == exporter.Endpoint {
+			return errors.New("Exporters '" + other.Name + "' and '" + exporter.Name +
+				"' both use address " + exporter.ListenAddress + " and endpoint '" + exporter.Endpoint + "'")
+		}
+
+		// Only the main address can be shared between exporters
+		if exporter.ListenAddress != c.MainListenAddress {
+			return errors.New("Exporters '" + other.Name + "' and '" + exporter.Name +
+				"' both use address " + exporter.ListenAddress + ", which can only be shared using the main address")
+		}
+	}
+	return nil
+}
+
+// ParseExporter parses and verifies the YAML definition of a single exporter
+func (c *Config) ParseExporter(data []byte) (ExporterConfig, error) {
+	return c.parseExporter(data, "")
+}
+
+// parseExporter parses and verifies the YAML definition of a single exporter,
+// resolving the relative paths it contains against the given directory
+func (c *Config) parseExporter(data []byte, dir string) (ExporterConfig, error) {
+	newExporter := ExporterConfig{}
+
+	// Parse the yaml directly into our data structure
+	if err := yaml.UnmarshalStrict(data, &newExporter); err != nil {
+		return newExporter, err
+	}
+
+	if newExporter.WebConfigFile != "" && !filepath.IsAbs(newExporter.WebConfigFile) {
+		newExporter.WebConfigFile = filepath.Join(dir, newExporter.WebConfigFile)
+	}
+
+	// Do some sanity checks on the configuration
+	err := c.verifyExporterConfig(&newExporter)
+	return newExporter, err
+}
+
+// parseExporterFile reads, parses and verifies the exporter defined in a file
+func (c *Config) parseExporterFile(file string) (ExporterConfig, error) {
+	// First extract the data out of the file
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ExporterConfig{}, err
+	}
+
+	return c.parseExporter(data, filepath.Dir(file))
+}
+
+// verifyWebConfigFile makes sure the web configuration file of the main webserver is valid
+func (c *Config) verifyWebConfigFile() error {
+	if err := web.Validate(c.WebConfigFile); err != nil {
+		return errors.New("Invalid web configuration file '" + c.WebConfigFile + "': " + err.Error())
+	}
 	return nil
 }
 
 // ParseConfig parses the YAML config files which provide
 // the definition and configuration of the exporters
 func (c *Config) ParseConfig() error {
+	if err := c.verifyWebConfigFile(); err != nil {
+		return err
+	}
+
 	// Check if all files exist
 	for _, file := range c.ConfigFiles {
 		if _, err := os.Stat(file); os.IsNotExist(err) {
@@ -151,20 +538,12 @@ func (c *Config) ParseConfig() error {
 
 	// Now parse the content of each file to populate our configuration
 	for _, file := range c.ConfigFiles {
-		// First extract the data out of the file
-		data, err := ioutil.ReadFile(file)
+		newExporter, err := c.parseExporterFile(file)
 		if err != nil {
 			return err
 		}
 
-		// Now parse the yaml directly into our data structure
-		newExporter := ExporterConfig{}
-		if err = yaml.UnmarshalStrict(data, &newExporter); err != nil {
-			return err
-		}
-
-		// Do some sanity checks on the configuration
-		if err = c.verifyExporterConfig(&newExporter); err != nil {
+		if err = c.verifyExporterCollision(&newExporter, c.Exporters); err != nil {
 			return err
 		}
 
@@ -174,3 +553,28 @@ func (c *Config) ParseConfig() error {
 
 	return nil
 }
+
+// Validate verifies each configuration file independently and reports the result
+// for every one of them.  Contrary to ParseConfig, it does not stop at the first error.
+// The exporters of the valid files are added to the configuration.
+func (c *Config) Validate() []FileValidation {
+	results := make([]FileValidation, 0, len(c.ConfigFiles)+1)
+
+	if c.WebConfigFile != "" {
+		results = append(results, FileValidation{File: c.WebConfigFile, Error: c.verifyWebConfigFile()})
+	}
+
+	for _, file := range c.ConfigFiles {
+		newExporter, err := c.parseExporterFile(file)
+		if err == nil {
+			err = c.verifyExporterCollision(&newExporter, c.Exporters)
+		}
+
+		if err == nil {
+			c.Exporters = append(c.Exporters, newExporter)
+		}
+		results = append(results, FileValidation{File: file, Error: err})
+	}
+
+	return results
+}
@@ -3,6 +3,7 @@ package configparser
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"gotest.tools/assert"
@@ -112,8 +113,9 @@ metrics:
 
 	c := Config{ConfigFiles: []string{filename}}
 	assert.NilError(t, c.ParseConfig())
-	// The port should remain unset as an indicator that the main port should be used
+	// The port should remain unset as an indicator that the main address should be used
 	assert.Equal(t, c.Exporters[0].Port, 0)
+	assert.Equal(t, c.Exporters[0].ListenAddress, c.MainListenAddress)
 	// Check that some other field of the config are correct
 	assert.Equal(t, *c.Exporters[0].Metrics[0].Executions[0].Timeout, defaultTimeout)
 }
@@ -341,7 +343,7 @@ metrics:
 
 	c := Config{ConfigFiles: []string{filename}}
 	assert.NilError(t, c.ParseConfig())
-	assert.Equal(t, *c.Exporters[0].Metrics[0].Executions[0].ExecutionType, defaultExecutionType)
+	assert.Equal(t, c.Exporters[0].Metrics[0].Executions[0].ExecutionType, defaultExecutionType)
 }
 
 func TestWrongMetricExecutionType(t *testing.T) {
@@ -550,3 +552,846 @@ metrics:
 	assert.NilError(t, c.ParseConfig())
 	assert.Equal(t, len(c.Exporters[0].Metrics[0].Executions[0].Labels), 0, "Labels should be empty based on config")
 }
+
+func TestInvalidMetricName(t *testing.T) {
+	data := `
+name: test-exporter
+port: 12345
+endpoint: /test
+metrics:
+- name: test-gauge-values      # Dashes are not allowed in metric names
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "is not a valid Prometheus metric name")
+}
+
+func TestCounterMetricName(t *testing.T) {
+	data := `
+name: test-exporter
+port: 12345
+endpoint: /test
+metrics:
+- name: test_counter           # Counters must end with _total
+  help: Some values
+  type: counter
+  executions:
+  - type: sh
+    command: expr 111
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "The name of a counter must end with '_total'")
+}
+
+func TestDefaultOpenMetrics(t *testing.T) {
+	c := Config{ConfigFiles: []string{"../example-configurations/test-exporter.yaml"}}
+	assert.NilError(t, c.ParseConfig())
+	assert.Equal(t, *c.Exporters[0].OpenMetrics, true)
+	assert.Equal(t, c.Exporters[0].CreatedTimestamps, false)
+}
+
+func TestReservedMetricName(t *testing.T) {
+	data := `
+name: test-exporter
+port: 12345
+endpoint: /test
+metrics:
+- name: custom_exporter_value  # Prefix of the metrics of the exporter itself
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "The prefix 'custom_exporter_' is reserved")
+}
+
+func TestDuplicateMetricName(t *testing.T) {
+	data := `
+name: test-exporter
+port: 12345
+endpoint: /test
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+- name: test_gauge_values      # Same name as the previous metric
+  help: Other values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 222
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "Duplicate metric name 'test_gauge_values'")
+}
+
+func TestInvalidLabelName(t *testing.T) {
+	data := `
+name: test-exporter
+port: 12345
+endpoint: /test
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+    labels:
+      __order: first           # Labels starting with __ are reserved
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "Invalid label name '__order'")
+}
+
+func TestInconsistentLabels(t *testing.T) {
+	data := `
+name: test-exporter
+port: 12345
+endpoint: /test
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+    labels:
+      order: first
+  - type: sh
+    command: expr 222
+    labels:
+      rank: second             # Different label name than the first execution
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "Labels differ from the ones of execution 0")
+}
+
+func TestDuplicateLabelValues(t *testing.T) {
+	data := `
+name: test-exporter
+port: 12345
+endpoint: /test
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+    labels:
+      order: first
+  - type: sh
+    command: expr 222
+    labels:
+      order: first             # Same labels as the first execution
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "Same label values as execution 0")
+}
+
+func TestDuplicateExporterName(t *testing.T) {
+	c := Config{ConfigFiles: []string{"../example-configurations/test-exporter.yaml", "../example-configurations/test-exporter.yaml"}}
+	assert.ErrorContains(t, c.ParseConfig(), "Duplicate exporter name 'test-exporter'")
+}
+
+func TestExporterPortCollision(t *testing.T) {
+	data := `
+name: other-exporter
+port: 12345                    # Same port as test-exporter
+endpoint: /other
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{MainListenAddress: ":9530", ConfigFiles: []string{"../example-configurations/test-exporter.yaml", filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "can only be shared using the main address")
+}
+
+func TestExporterMainAddressSharing(t *testing.T) {
+	data := `
+name: other-exporter
+port: 9530                     # Same port as the main webserver
+endpoint: /other
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{MainListenAddress: ":9530", ConfigFiles: []string{filename}}
+	assert.NilError(t, c.ParseConfig())
+}
+
+func exporterWithAddress(name string, address string) string {
+	return `
+name: ` + name + `
+` + address + `
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+`
+}
+
+func TestExporterListenAddress(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	for address, expected := range map[string]string{
+		"port: 12345":                       ":12345",
+		"listenAddress: 127.0.0.1:12345":    "127.0.0.1:12345",
+		"listenAddress: '[::1]:12345'":      "[::1]:12345",
+		"listenAddress: unix:/tmp/exp.sock": "unix:/tmp/exp.sock",
+		"#listenAddress: omitted":           ":9530",
+	} {
+		exporter, err := c.ParseExporter([]byte(exporterWithAddress("test-exporter", address)))
+		assert.NilError(t, err)
+		assert.Equal(t, exporter.ListenAddress, expected)
+	}
+}
+
+func TestExporterInvalidListenAddress(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	for address, expected := range map[string]string{
+		"listenAddress: 127.0.0.1":             "Invalid listen address '127.0.0.1'",
+		"listenAddress: localhost:http":        "Invalid port in listen address 'localhost:http'",
+		"listenAddress: 'unix:'":               "Missing path of the Unix socket",
+		"port: 12345\nlistenAddress: ':12345'": "Fields 'port' and 'listenAddress' cannot be used together",
+	} {
+		_, err := c.ParseExporter([]byte(exporterWithAddress("test-exporter", address)))
+		assert.ErrorContains(t, err, expected)
+	}
+}
+
+func TestExporterOverlappingAddresses(t *testing.T) {
+	first := createFile(t, exporterWithAddress("first-exporter", "listenAddress: 127.0.0.1:12345"))
+	defer removeFile(first)
+	c := Config{MainListenAddress: ":9530", ConfigFiles: []string{"../example-configurations/test-exporter.yaml", first}}
+	assert.ErrorContains(t, c.ParseConfig(), "use the overlapping addresses :12345 and 127.0.0.1:12345")
+
+	c = Config{MainListenAddress: "127.0.0.1:12345", ConfigFiles: []string{"../example-configurations/test-exporter.yaml"}}
+	assert.ErrorContains(t, c.ParseConfig(), "overlaps with the address 127.0.0.1:12345 of the main webserver")
+
+	// Different interfaces can use the same port
+	assert.Assert(t, !overlappingAddresses("127.0.0.1:12345", "[::1]:12345"))
+	assert.Assert(t, overlappingAddresses("[::]:12345", "[::1]:12345"))
+}
+
+func TestExporterMainEndpointCollision(t *testing.T) {
+	data := `
+name: other-exporter
+#port: 9530                    # Defaults to the main port
+endpoint: /validate            # Endpoint of the main webserver
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{MainListenAddress: ":9530", ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "is reserved by the main webserver")
+}
+
+func TestInvalidWebConfigFile(t *testing.T) {
+	filename := createFile(t, "basic_auth_users:\n  prometheus: not-a-bcrypt-hash\n")
+	defer removeFile(filename)
+
+	c := Config{WebConfigFile: filename, ConfigFiles: []string{"../example-configurations/test-exporter.yaml"}}
+	assert.ErrorContains(t, c.ParseConfig(), "Invalid web configuration file")
+}
+
+func TestExporterWebConfigFile(t *testing.T) {
+	data := `
+name: other-exporter
+port: 12345
+webConfigFile: web-config.yaml # Relative to the directory of the configuration file
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+`
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "exporter.yaml")
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(data), 0644))
+
+	c := Config{MainListenAddress: ":9530", ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "Invalid web configuration file '"+filepath.Join(dir, "web-config.yaml")+"'")
+
+	webConfig, err := ioutil.ReadFile("../example-configurations/web-config.yaml")
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "web-config.yaml"), webConfig, 0644))
+
+	c = Config{MainListenAddress: ":9530", ConfigFiles: []string{filename}}
+	assert.NilError(t, c.ParseConfig())
+	assert.Equal(t, c.Exporters[0].WebConfigFile, filepath.Join(dir, "web-config.yaml"))
+}
+
+func TestExporterWebConfigFileDefault(t *testing.T) {
+	c := Config{
+		MainListenAddress: ":9530",
+		WebConfigFile:     "../example-configurations/web-config.yaml",
+		ConfigFiles:       []string{"../example-configurations/test-exporter.yaml"},
+	}
+	assert.NilError(t, c.ParseConfig())
+	assert.Equal(t, c.Exporters[0].WebConfigFile, "../example-configurations/web-config.yaml")
+}
+
+func TestExporterWebConfigFileOnMainAddress(t *testing.T) {
+	data := `
+name: other-exporter
+#port: 9530                    # Defaults to the main port
+endpoint: /other
+webConfigFile: /etc/web-config.yaml # Cannot differ from the one of the main webserver
+metrics:
+- name: test_gauge_values
+  help: Some values
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 111
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	c := Config{MainListenAddress: ":9530", ConfigFiles: []string{filename}}
+	assert.ErrorContains(t, c.ParseConfig(), "Field 'webConfigFile' cannot be used by an exporter using the main address")
+}
+
+func TestValidateReportsEveryFile(t *testing.T) {
+	c := Config{ConfigFiles: []string{
+		"missing.yaml",
+		"../example-configurations/test-exporter.yaml",
+		"../example-configurations/docker-exporter.yaml",
+	}}
+	results := c.Validate()
+
+	assert.Equal(t, len(results), 3)
+	assert.ErrorContains(t, results[0].Error, "missing.yaml: no such file or directory")
+	assert.NilError(t, results[1].Error)
+	assert.NilError(t, results[2].Error)
+	assert.Equal(t, len(c.Exporters), 2)
+}
+
+func TestTestsFile(t *testing.T) {
+	tests, err := ParseTestsFile("../example-configurations/docker-exporter_test.yaml")
+	assert.NilError(t, err)
+	assert.Equal(t, tests.Exporter, "docker-exporter")
+	assert.Equal(t, tests.Tests[1].Stubs[0].ExitCode, 1)
+}
+
+func TestTestsFileMissingExpected(t *testing.T) {
+	data := `
+exporter: test-exporter
+tests:
+- name: missing expected
+  stubs:
+  - command: expr 111
+    stdout: "111"
+#  expected: |                 # Missing field should cause error
+`
+	filename := createFile(t, data)
+	defer removeFile(filename)
+
+	_, err := ParseTestsFile(filename)
+	assert.ErrorContains(t, err, "Missing field 'expected' in 'tests' configuration")
+}
+
+func TestProbeMetrics(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	exporter, err := c.ParseExporter([]byte(`
+name: test-probe
+probe:
+  params:
+  - module
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: check {{ .Target }} {{ .Params.module }} --format '{{ "{{" }} .Value }}'
+`))
+	assert.NilError(t, err)
+
+	metrics, err := exporter.ProbeMetrics("host'; rm -rf /; echo '", map[string]string{"module": "disk", "other": "ignored"})
+	assert.NilError(t, err)
+	assert.Equal(t, metrics[0].Executions[0].Command, `check 'host'\''; rm -rf /; echo '\''' 'disk' --format '{{ .Value }}'`)
+	// The configuration of the exporter is left untouched
+	assert.Equal(t, exporter.Metrics[0].Executions[0].Command, `check {{ .Target }} {{ .Params.module }} --format '{{ "{{" }} .Value }}'`)
+
+	metrics, err = exporter.ProbeMetrics("host", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, metrics[0].Executions[0].Command, `check 'host' '' --format '{{ .Value }}'`)
+
+	_, err = exporter.ProbeMetrics("", nil)
+	assert.ErrorContains(t, err, "Missing query parameter 'target'")
+
+	_, err = exporter.ProbeMetrics("host\nreboot", nil)
+	assert.ErrorContains(t, err, "Invalid value for query parameter 'target'")
+}
+
+func TestProbeInvalidConfig(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	probe := func(probeConfig string, command string) error {
+		_, err := c.ParseExporter([]byte(`
+name: test-probe
+` + probeConfig + `
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: ` + command + `
+`))
+		return err
+	}
+
+	assert.ErrorContains(t, probe("probe: {}", "check {{ .Params.module }}"),
+		"Invalid template for field 'command' in 'executions' configuration of metric 0 and execution 0")
+	assert.ErrorContains(t, probe("probe: {}", "check {{ .Target"),
+		"Invalid template for field 'command'")
+	assert.ErrorContains(t, probe("probe:\n  params: [target]", "check {{ .Target }}"),
+		"'target' is not a valid parameter name")
+	assert.ErrorContains(t, probe("minInterval: 1000\nprobe: {}", "check {{ .Target }}"),
+		"Field 'minInterval' cannot be used by a probe")
+	assert.ErrorContains(t, probe("probe: {}", "check {{ .Target }}\n    cacheTTL: 1000"),
+		"Field 'cacheTTL' cannot be used by a probe in 'executions' configuration of metric 0 and execution 0")
+	assert.NilError(t, probe("probe: {}", "check {{ .Target }}"))
+}
+
+func TestTemplates(t *testing.T) {
+	os.Setenv("TEST_TEMPLATE_DISK", "/var/lib/My Data")
+	defer os.Unsetenv("TEST_TEMPLATE_DISK")
+	hostname, _ := os.Hostname()
+
+	c := Config{MainListenAddress: ":9530"}
+	exporter, err := c.ParseExporter([]byte(`
+name: test-exporter
+templates: true
+metrics:
+- name: test_value
+  help: Some value of {{ .Exporter }}
+  type: gauge
+  executions:
+  - type: sh
+    command: df --output=used {{ env "TEST_TEMPLATE_DISK" | shellquote }}
+    labels:
+      disk: '{{ env "TEST_TEMPLATE_DISK" | lower }}'
+      host: '{{ .Hostname }}'
+`))
+	assert.NilError(t, err)
+	assert.Equal(t, exporter.Metrics[0].Help, "Some value of test-exporter")
+	assert.Equal(t, exporter.Metrics[0].Executions[0].Command, `df --output=used '/var/lib/My Data'`)
+	assert.DeepEqual(t, exporter.Metrics[0].Executions[0].Labels, map[string]string{"disk": "/var/lib/my data", "host": hostname})
+}
+
+func TestTemplatesDisabled(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	exporter, err := c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: docker info --format '{{ .ContainersRunning }}'
+`))
+	assert.NilError(t, err)
+	assert.Equal(t, exporter.Metrics[0].Executions[0].Command, `docker info --format '{{ .ContainersRunning }}'`)
+}
+
+func TestTemplatesInvalid(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	_, err := c.ParseExporter([]byte(`
+name: test-exporter
+templates: true
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 1
+    labels:
+      target: '{{ .Target | unknown }}'
+`))
+	assert.ErrorContains(t, err, "Invalid template for label 'target' in 'executions' configuration of metric 0 and execution 0")
+}
+
+func TestTemplatesSameLabelValues(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	_, err := c.ParseExporter([]byte(`
+name: test-exporter
+templates: true
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 1
+    labels:
+      name: '{{ lower "A" }}'
+  - type: sh
+    command: expr 2
+    labels:
+      name: a
+`))
+	assert.ErrorContains(t, err, "Same label values as execution 0")
+}
+
+func TestProbeTemplates(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	exporter, err := c.ParseExporter([]byte(`
+name: test-probe
+probe: {}
+metrics:
+- name: test_value
+  help: Some value of {{ .Target }}
+  type: gauge
+  executions:
+  - type: sh
+    command: check {{ .Target }}
+    labels:
+      host: '{{ .Target | lower }}'
+`))
+	assert.NilError(t, err)
+
+	// The values of the scrape are only shell-quoted in the commands
+	metrics, err := exporter.ProbeMetrics("Host A", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, metrics[0].Help, "Some value of Host A")
+	assert.Equal(t, metrics[0].Executions[0].Command, "check 'Host A'")
+	assert.DeepEqual(t, metrics[0].Executions[0].Labels, map[string]string{"host": "host a"})
+}
+
+func TestForeachItems(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	exporter, err := c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_value
+  help: Some value of {{ .Exporter }}
+  type: gauge
+  foreach:
+    items: [Running, Stopped]
+  executions:
+  - type: sh
+    command: docker info --format '{{ "{{" }} .Containers{{ .Item }} }}'
+    labels:
+      state: '{{ .Item | lower }}'
+`))
+	assert.NilError(t, err)
+
+	// The help is also rendered, as the templates are always on for the 'foreach' metrics
+	assert.Equal(t, exporter.Metrics[0].Help, "Some value of test-exporter")
+
+	executions := exporter.Metrics[0].Executions
+	assert.Equal(t, len(executions), 2)
+	assert.Equal(t, executions[0].Command, "docker info --format '{{ .ContainersRunning }}'")
+	assert.DeepEqual(t, executions[1].Labels, map[string]string{"state": "stopped"})
+	assert.Equal(t, *executions[1].Timeout, defaultTimeout)
+}
+
+func TestForeachInvalid(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	foreach := func(foreachConfig string, labels string) error {
+		_, err := c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  foreach:
+` + foreachConfig + `
+  executions:
+  - type: sh
+    command: expr 1
+` + labels))
+		return err
+	}
+
+	withLabels := "    labels:\n      item: '{{ .Item }}'\n"
+	assert.ErrorContains(t, foreach("    items: [a]\n    command: ls", withLabels),
+		"Fields 'items' and 'command' cannot be used together in 'foreach' configuration of metric 0")
+	assert.ErrorContains(t, foreach("    type: sh", withLabels),
+		"Missing field 'items' or 'command' in 'foreach' configuration of metric 0")
+	assert.ErrorContains(t, foreach("    items: [a, a]", withLabels), "Duplicate item 'a'")
+	assert.ErrorContains(t, foreach("    command: ls", ""), "which is required with the 'command' of 'foreach'")
+	assert.ErrorContains(t, foreach("    items: [a, b]", "    labels:\n      item: same\n"), "Same label values as execution 0")
+	assert.ErrorContains(t, foreach("    command: ls", "    labels:\n      kind: fixed\n"),
+		"Labels do not tell apart the discovered items, using {{ .Item }}, in 'executions' configuration of metric 0 and execution 0")
+	assert.NilError(t, foreach("    command: ls", withLabels))
+}
+
+func TestValueMap(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	exporter, err := c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: systemctl is-active cron || true
+    valueMap: {active: 1, inactive: 0, failed: -1}
+    defaultValue: -2
+`))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, exporter.Metrics[0].Executions[0].ValueMap, map[string]float64{"active": 1, "inactive": 0, "failed": -1})
+	assert.Equal(t, *exporter.Metrics[0].Executions[0].DefaultValue, float64(-2))
+
+	_, err = c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: expr 1
+    defaultValue: 0
+`))
+	assert.ErrorContains(t, err, "Field 'defaultValue' requires field 'valueMap' in 'executions' configuration of metric 0 and execution 0")
+}
+
+func TestValueFrom(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	valueFrom := func(fields string) (ExporterConfig, error) {
+		return c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: pg_isready
+` + fields))
+	}
+
+	exporter, err := valueFrom("")
+	assert.NilError(t, err)
+	assert.Equal(t, exporter.Metrics[0].Executions[0].ValueFrom, "stdout")
+
+	exporter, err = valueFrom("    valueFrom: exitCode\n")
+	assert.NilError(t, err)
+	assert.Equal(t, exporter.Metrics[0].Executions[0].ValueFrom, "exitCode")
+
+	_, err = valueFrom("    valueFrom: stderr\n")
+	assert.ErrorContains(t, err, "Wrong value for field 'valueFrom' in 'executions' configuration of metric 0 and execution 0")
+
+	_, err = valueFrom("    valueFrom: exitCode\n    valueMap: {up: 1}\n")
+	assert.ErrorContains(t, err, "Field 'valueMap' can only be used with 'valueFrom: stdout'")
+}
+
+func TestTimestampFrom(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	timestampFrom := func(executions string) (ExporterConfig, error) {
+		return c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+` + executions))
+	}
+
+	exporter, err := timestampFrom("  - type: sh\n    command: cat /var/lib/batch/result\n")
+	assert.NilError(t, err)
+	assert.Equal(t, exporter.Metrics[0].Executions[0].TimestampFrom, "scrape")
+
+	exporter, err = timestampFrom("  - type: sh\n    command: cat /var/lib/batch/result\n    timestampFrom: output\n")
+	assert.NilError(t, err)
+	assert.Equal(t, exporter.Metrics[0].Executions[0].TimestampFrom, "output")
+
+	_, err = timestampFrom("  - type: sh\n    command: cat /var/lib/batch/result\n    timestampFrom: mtime\n")
+	assert.ErrorContains(t, err, "Wrong value for field 'timestampFrom' in 'executions' configuration of metric 0 and execution 0")
+
+	_, err = timestampFrom("  - type: sh\n    command: cat /var/lib/batch/result\n    valueFrom: exitCode\n    timestampFrom: output\n")
+	assert.ErrorContains(t, err, "Field 'timestampFrom: output' can only be used with 'valueFrom: stdout'")
+
+	_, err = timestampFrom("  - type: expression\n    command: 1 + 1\n    timestampFrom: output\n")
+	assert.ErrorContains(t, err, "Field 'timestampFrom' cannot be used by an execution of type 'expression'")
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	exporter, err := c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_images
+  help: Some images
+  type: gauge
+  cacheTTL: 3600000
+  staleWhileRevalidate: true
+  executions:
+  - type: sh
+    command: docker images -q | wc -l
+    labels:
+      type: all
+  - type: sh
+    command: docker images -q -f dangling=true | wc -l
+    cacheTTL: 0
+    staleWhileRevalidate: false
+    labels:
+      type: dangling
+  - type: expression
+    command: 1
+    labels:
+      type: constant
+`))
+	assert.NilError(t, err)
+	executions := exporter.Metrics[0].Executions
+	assert.Equal(t, *executions[0].CacheTTL, uint(3600000))
+	assert.Equal(t, *executions[0].StaleWhileRevalidate, true)
+	assert.Equal(t, *executions[1].CacheTTL, uint(0))
+	assert.Equal(t, *executions[1].StaleWhileRevalidate, false)
+	assert.Assert(t, executions[2].CacheTTL == nil)
+
+	cache := func(fields string) error {
+		_, err := c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+` + fields))
+		return err
+	}
+	assert.ErrorContains(t, cache("  - type: sh\n    command: expr 1\n    staleWhileRevalidate: true\n"),
+		"Field 'staleWhileRevalidate' requires field 'cacheTTL' in 'executions' configuration of metric 0 and execution 0")
+	assert.ErrorContains(t, cache("  - type: expression\n    command: 1\n    cacheTTL: 1000\n"),
+		"Fields 'cacheTTL' and 'staleWhileRevalidate' cannot be used by an execution of type 'expression'")
+}
+
+func TestRetries(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	retries := func(fields string) (ExporterConfig, error) {
+		return c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_containers
+  help: Some containers
+  type: gauge
+  executions:
+  - type: sh
+    command: docker ps -q | wc -l
+` + fields))
+	}
+
+	exporter, err := retries("    retries: 2\n    retryDelay: 100\n    circuitBreaker: {failures: 3, openDuration: 60000}\n")
+	assert.NilError(t, err)
+	execution := exporter.Metrics[0].Executions[0]
+	assert.Equal(t, execution.Retries, uint(2))
+	assert.Equal(t, execution.RetryDelay, uint(100))
+	assert.DeepEqual(t, *execution.CircuitBreaker, CircuitBreakerConfig{Failures: 3, OpenDuration: 60000})
+
+	_, err = retries("    retryDelay: 100\n")
+	assert.ErrorContains(t, err, "Field 'retryDelay' requires field 'retries' in 'executions' configuration of metric 0 and execution 0")
+	_, err = retries("    circuitBreaker: {openDuration: 60000}\n")
+	assert.ErrorContains(t, err, "Missing field 'failures' in 'circuitBreaker' of 'executions' configuration of metric 0 and execution 0")
+	_, err = retries("    circuitBreaker: {failures: 3}\n")
+	assert.ErrorContains(t, err, "Missing field 'openDuration' in 'circuitBreaker'")
+}
+
+func TestExpressionsInvalid(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	expressions := func(first string, second string) error {
+		_, err := c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    id: used
+    command: expr 1
+    labels:
+      type: used
+` + first + `
+- name: other_value
+  help: Some value
+  type: gauge
+  executions:
+` + second))
+		return err
+	}
+
+	free := "  - type: expression\n    id: free\n    command: 10 - used\n    labels:\n      type: free\n"
+	assert.NilError(t, expressions(free, "  - type: expression\n    command: free / (used + free)\n"))
+
+	assert.ErrorContains(t, expressions(free, "  - type: expression\n    command: free / total\n"),
+		"Unknown execution id 'total' in the expression of 'executions' configuration of metric 1 and execution 0")
+	assert.ErrorContains(t, expressions(free, "  - type: expression\n    command: free +\n"),
+		"Invalid expression in 'executions' configuration of metric 1 and execution 0: Unexpected end of expression")
+	assert.ErrorContains(t, expressions(free, "  - type: sh\n    id: used\n    command: expr 2\n"),
+		"Duplicate execution id 'used' in 'executions' configuration of metric 1 and execution 0, "+
+			"already used in 'executions' configuration of metric 0 and execution 0")
+	assert.ErrorContains(t, expressions(free, "  - type: expression\n    id: total\n    command: 1 + 2\n    valueFrom: exitCode\n"),
+		"Fields 'valueFrom' and 'valueMap' cannot be used by an execution of type 'expression'")
+	assert.ErrorContains(t, expressions(free, "  - type: sh\n    id: 2nd\n    command: expr 2\n"),
+		"'2nd' is not a valid execution id")
+	assert.ErrorContains(t,
+		expressions("  - type: expression\n    id: free\n    command: total - used\n    labels:\n      type: free\n",
+			"  - type: expression\n    id: total\n    command: free + used\n"),
+		"Circular reference to execution 'free'")
+}
@@ -0,0 +1,116 @@
+package configparser
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/expression"
+)
+
+// The type of the executions computing their value from other executions
+const expressionExecutionType = "expression"
+
+// executionLocation identifies an execution in the configuration, for the errors
+type executionLocation struct {
+	metric    int
+	execution int
+}
+
+func (l executionLocation) String() string {
+	return "'executions' configuration of metric " + strconv.Itoa(l.metric) + " and execution " + strconv.Itoa(l.execution)
+}
+
+// verifyExpressions makes sure the ids of the executions are unique, and that the
+// expressions are valid and only use the ids of executions without circular references
+func verifyExpressions(exporter *ExporterConfig) error {
+	ids := map[string]executionLocation{}
+	// The ids used by each expression, by location and by id of the expression
+	expressions := map[executionLocation][]string{}
+	dependencies := map[string][]string{}
+
+	for i, metric := range exporter.Metrics {
+		for j, execution := range metric.Executions {
+			location := executionLocation{i, j}
+			if execution.ExecutionType == expressionExecutionType {
+				if execution.ValueFrom != defaultValueFrom || len(execution.ValueMap) > 0 {
+					return errors.New("Fields 'valueFrom' and 'valueMap' cannot be used by an execution of type 'expression' in " +
+						location.String())
+				}
+				if execution.CacheTTL != nil || execution.StaleWhileRevalidate != nil {
+					return errors.New("Fields 'cacheTTL' and 'staleWhileRevalidate' cannot be used by an execution of type 'expression' in " +
+						location.String())
+				}
+				if execution.Retries != 0 || execution.CircuitBreaker != nil {
+					return errors.New("Fields 'retries' and 'circuitBreaker' cannot be used by an execution of type 'expression' in " +
+						location.String())
+				}
+				if execution.TimestampFrom != defaultTimestampFrom {
+					return errors.New("Field 'timestampFrom' cannot be used by an execution of type 'expression' in " +
+						location.String())
+				}
+
+				parsed, err := expression.Parse(execution.Command)
+				if err != nil {
+					return errors.New("Invalid expression in " + location.String() + ": " + err.Error())
+				}
+				expressions[location] = parsed.Variables()
+				if execution.ID != "" {
+					dependencies[execution.ID] = parsed.Variables()
+				}
+			}
+
+			if execution.ID == "" {
+				continue
+			}
+
+			if metric.Foreach != nil {
+				return errors.New("Field 'id' cannot be used by the executions generated by 'foreach' in " + location.String())
+			}
+
+			if !labelNameRegexp.MatchString(execution.ID) {
+				return errors.New("Wrong value for field 'id' in " + location.String() +
+					". '" + execution.ID + "' is not a valid execution id")
+			}
+
+			if previous, ok := ids[execution.ID]; ok {
+				return errors.New("Duplicate execution id '" + execution.ID + "' in " + location.String() +
+					", already used in " + previous.String())
+			}
+			ids[execution.ID] = location
+		}
+	}
+
+	for i, metric := range exporter.Metrics {
+		for j, execution := range metric.Executions {
+			location := executionLocation{i, j}
+			for _, name := range expressions[location] {
+				if _, ok := ids[name]; !ok {
+					return errors.New("Unknown execution id '" + name + "' in the expression of " + location.String())
+				}
+			}
+
+			if execution.ID != "" && dependsOn(dependencies, execution.ID, execution.ID, map[string]bool{}) {
+				return errors.New("Circular reference to execution '" + execution.ID + "' in the expression of " +
+					location.String())
+			}
+		}
+	}
+	return nil
+}
+
+// dependsOn returns true if the expression of an execution uses the value of
+// another execution, directly or through other expressions
+func dependsOn(dependencies map[string][]string, id string, other string, visited map[string]bool) bool {
+	for _, name := range dependencies[id] {
+		if name == other {
+			return true
+		}
+		if !visited[name] {
+			visited[name] = true
+			if dependsOn(dependencies, name, other, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
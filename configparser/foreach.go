@@ -0,0 +1,109 @@
+package configparser
+
+import (
+	"errors"
+	"strconv"
+)
+
+// ForeachConfig generates the executions of a metric for each item of a list,
+// which the templates of the executions get as {{ .Item }}
+type ForeachConfig struct {
+	// All fields below, except data, must be exported (start with a capital letter)
+	// so that the yaml.UnmarshalStrict() method can set them.
+	Items []string
+	// A command run at each scrape, whose output gives the items, one per line
+	Command       string
+	ExecutionType string `yaml:"type"`
+	Timeout       *uint  // A pointer so we can check for nil (missing)
+
+	// The data of the templates of the executions, rendered for each
+	// scrape once the items are discovered
+	data templateData
+}
+
+// DiscoveryExecution returns the execution running the command which discovers the items
+func (f *ForeachConfig) DiscoveryExecution() ExecutionConfig {
+	return ExecutionConfig{
+		ExecutionType: f.ExecutionType,
+		Command:       f.Command,
+		Timeout:       f.Timeout,
+	}
+}
+
+// verifyForeachConfig makes sure the items of a metric are either listed or discovered
+func verifyForeachConfig(metric *MetricsConfig, index int) error {
+	foreach := metric.Foreach
+	if len(foreach.Items) > 0 && foreach.Command != "" {
+		return errors.New("Fields 'items' and 'command' cannot be used together in 'foreach' configuration of metric " +
+			strconv.Itoa(index))
+	}
+
+	if len(foreach.Items) == 0 && foreach.Command == "" {
+		return errors.New("Missing field 'items' or 'command' in 'foreach' configuration of metric " + strconv.Itoa(index))
+	}
+
+	for i, item := range foreach.Items {
+		for k := 0; k < i; k++ {
+			if foreach.Items[k] == item {
+				return errors.New("Duplicate item '" + item + "' in 'foreach' configuration of metric " + strconv.Itoa(index))
+			}
+		}
+	}
+
+	if foreach.Command == "" {
+		return nil
+	}
+
+	if foreach.ExecutionType == "" {
+		foreach.ExecutionType = defaultExecutionType
+	}
+	if !contains(supportedShells, foreach.ExecutionType) {
+		return errors.New("Wrong value for field 'type' in 'foreach' configuration of metric " + strconv.Itoa(index) +
+			". Supported values are: sh, bash, tcsh or zsh")
+	}
+
+	if foreach.Timeout == nil {
+		defaultT := defaultTimeout
+		foreach.Timeout = &defaultT
+	}
+
+	// The labels tell apart the executions of the discovered items
+	for j, execution := range metric.Executions {
+		if len(execution.Labels) == 0 {
+			return errors.New("Missing field 'labels' in 'executions' configuration of metric " + strconv.Itoa(index) +
+				" and execution " + strconv.Itoa(j) + ", which is required with the 'command' of 'foreach'")
+		}
+	}
+	return nil
+}
+
+// ForeachExecutions returns the executions of a metric generated for the items
+// discovered by the command of its 'foreach', which are substituted shell-quoted in
+// the commands.  Duplicate items are ignored.
+func (m MetricsConfig) ForeachExecutions(items []string) ([]ExecutionConfig, error) {
+	if m.Foreach == nil {
+		return nil, errors.New("Metric '" + m.Name + "' has no 'foreach' configuration")
+	}
+
+	var executions []ExecutionConfig
+	seen := map[string]bool{}
+	for _, item := range items {
+		if seen[item] {
+			continue
+		}
+		seen[item] = true
+
+		data := m.Foreach.data
+		data.Item = item
+		data.discovered = true
+		for j, execution := range m.Executions {
+			rendered, err := renderExecution(execution, data,
+				"'executions' configuration of metric '"+m.Name+"' and execution "+strconv.Itoa(j))
+			if err != nil {
+				return nil, err
+			}
+			executions = append(executions, rendered)
+		}
+	}
+	return executions, nil
+}
@@ -0,0 +1,75 @@
+package configparser
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The prefix of the listen addresses which are Unix sockets, followed by the path of the socket
+const unixSocketPrefix = "unix:"
+
+// ListenNetwork returns the network and the address to use with net.Listen for a listen
+// address, which is either [host]:port or unix:<path>
+func ListenNetwork(listenAddress string) (network string, address string) {
+	if strings.HasPrefix(listenAddress, unixSocketPrefix) {
+		return "unix", strings.TrimPrefix(listenAddress, unixSocketPrefix)
+	}
+	return "tcp", listenAddress
+}
+
+// verifyListenAddress makes sure a listen address is either [host]:port or unix:<path>
+func verifyListenAddress(listenAddress string) error {
+	network, address := ListenNetwork(listenAddress)
+	if network == "unix" {
+		if address == "" {
+			return errors.New("Missing path of the Unix socket in listen address '" + listenAddress + "'")
+		}
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.New("Invalid listen address '" + listenAddress + "'. Use [host]:port or unix:<path>")
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return errors.New("Invalid port in listen address '" + listenAddress + "'")
+	}
+	return nil
+}
+
+func isWildcardHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+// overlappingAddresses returns true if two different listen addresses cannot be used
+// at the same time, because they use the same port and one of them listens on all
+// interfaces, or because they only differ by their notation
+func overlappingAddresses(first string, second string) bool {
+	firstNetwork, firstAddress := ListenNetwork(first)
+	secondNetwork, secondAddress := ListenNetwork(second)
+	if firstNetwork != "tcp" || secondNetwork != "tcp" {
+		return false
+	}
+
+	firstHost, firstPort, err := net.SplitHostPort(firstAddress)
+	if err != nil {
+		return false
+	}
+	secondHost, secondPort, err := net.SplitHostPort(secondAddress)
+	if err != nil || firstPort != secondPort {
+		return false
+	}
+
+	if isWildcardHost(firstHost) || isWildcardHost(secondHost) {
+		return true
+	}
+
+	firstIP, secondIP := net.ParseIP(firstHost), net.ParseIP(secondHost)
+	if firstIP != nil && secondIP != nil {
+		return firstIP.Equal(secondIP)
+	}
+	return firstHost == secondHost
+}
@@ -0,0 +1,109 @@
+package configparser
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The query parameter giving the target of a probe
+const probeTargetParam = "target"
+
+// ProbeConfig turns an exporter into a probe, whose commands are templates run
+// against the target given by each scrape, like the blackbox_exporter
+type ProbeConfig struct {
+	// All fields below must be exported (start with a capital letter)
+	// so that the yaml.UnmarshalStrict() method can set them.
+
+	// The query parameters, besides 'target', which the commands can use
+	Params []string
+}
+
+// probeTemplateData returns the data of the templates of a probe for a target and the
+// values of the parameters of the probe.  The parameters which are not given are empty.
+func (e *ExporterConfig) probeTemplateData(target string, params map[string]string) (templateData, error) {
+	if err := verifyProbeValue(probeTargetParam, target); err != nil {
+		return templateData{}, err
+	}
+
+	values := map[string]string{}
+	for _, name := range e.Probe.Params {
+		if err := verifyProbeValue(name, params[name]); err != nil {
+			return templateData{}, err
+		}
+		values[name] = params[name]
+	}
+	return newTemplateData(e, target, values), nil
+}
+
+func verifyProbeValue(name string, value string) error {
+	// A newline cannot be quoted for every shell, and would end the command,
+	// and the label values using the value must be valid UTF-8
+	if strings.ContainsAny(value, "\n\r\x00") || !utf8.ValidString(value) {
+		return errors.New("Invalid value for query parameter '" + name + "'")
+	}
+	return nil
+}
+
+// verifyProbeConfig makes sure the parameters of a probe are valid and that
+// the templates of the exporter can be rendered
+func verifyProbeConfig(exporter *ExporterConfig) error {
+	for i, name := range exporter.Probe.Params {
+		if !labelNameRegexp.MatchString(name) || name == probeTargetParam {
+			return errors.New("Wrong value for field 'params' in 'probe' configuration of parameter " + strconv.Itoa(i) +
+				". '" + name + "' is not a valid parameter name")
+		}
+	}
+
+	// Each probe targets a different host, whose results cannot be reused by the next scrape
+	if exporter.MinInterval != 0 {
+		return errors.New("Field 'minInterval' cannot be used by a probe in top configuration")
+	}
+	for i, metric := range exporter.Metrics {
+		if metric.CacheTTL != nil {
+			return errors.New("Field 'cacheTTL' cannot be used by a probe in 'metrics' configuration of metric " + strconv.Itoa(i))
+		}
+		for j, execution := range metric.Executions {
+			if execution.CacheTTL != nil {
+				return errors.New("Field 'cacheTTL' cannot be used by a probe in " + executionLocation{i, j}.String())
+			}
+			if execution.CircuitBreaker != nil {
+				return errors.New("Field 'circuitBreaker' cannot be used by a probe in " + executionLocation{i, j}.String())
+			}
+		}
+	}
+
+	// The executions generated from the items of a 'foreach' must be told apart
+	data, _ := exporter.probeTemplateData("target", nil)
+	metrics, err := renderMetrics(exporter.Metrics, data, true)
+	if err != nil {
+		return err
+	}
+	for i, metric := range metrics {
+		for j := range metric.Executions {
+			if err := verifyLabels(metric.Executions, j); err != nil {
+				return errors.New(err.Error() + " in 'executions' configuration of metric " + strconv.Itoa(i) +
+					" and execution " + strconv.Itoa(j))
+			}
+		}
+	}
+	return nil
+}
+
+// ProbeMetrics returns the metrics of a probe whose templates are rendered for
+// a target and the values of the parameters of the probe
+func (e ExporterConfig) ProbeMetrics(target string, params map[string]string) ([]MetricsConfig, error) {
+	if e.Probe == nil {
+		return nil, errors.New("Exporter '" + e.Name + "' is not a probe")
+	}
+	if target == "" {
+		return nil, errors.New("Missing query parameter '" + probeTargetParam + "'")
+	}
+
+	data, err := e.probeTemplateData(target, params)
+	if err != nil {
+		return nil, err
+	}
+	return renderMetrics(e.Metrics, data, true)
+}
@@ -0,0 +1,322 @@
+package configparser
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+const schemaID = "https://raw.githubusercontent.com/marckhouzam/custom-prometheus-exporter/master/schema/exporter-config.schema.json"
+
+// schemaProperty holds the information of a configuration field which
+// cannot be deduced from its Go type
+type schemaProperty struct {
+	description string
+	required    bool
+	defaultVal  interface{}
+	enum        []string
+}
+
+// schemaProperties documents every field of the configuration.  The key is the
+// path of the field in the YAML file, where array elements are not represented.
+// Every field of the configuration structures must have an entry here, which is
+// verified by the tests.
+var schemaProperties = map[string]schemaProperty{
+	"name": {
+		description: "A name for the exporter",
+		required:    true,
+	},
+	"port": {
+		description: "The TCP port serving the metrics, on all interfaces. Cannot be used with listenAddress. " +
+			"Defaults to the address of the main webserver",
+	},
+	"listenAddress": {
+		description: "The address serving the metrics, either [host]:port or unix:<path> for a Unix socket. " +
+			"Cannot be used with port. Defaults to the address of the main webserver",
+	},
+	"endpoint": {
+		description: "The endpoint serving the metrics",
+		defaultVal:  defaultEndpoint,
+	},
+	"webConfigFile": {
+		description: "A web configuration file (in the Prometheus exporter-toolkit format) enabling TLS and " +
+			"basic authentication on the port of the exporter. Relative to the directory of the configuration file. " +
+			"Defaults to the web configuration of the main webserver, and cannot be used with the address of the main webserver",
+	},
+	"openMetrics": {
+		description: "Serve the OpenMetrics format to the scrapers requesting it",
+		defaultVal:  defaultOpenMetrics,
+	},
+	"createdTimestamps": {
+		description: "Add the _created samples of the counters to the OpenMetrics format, " +
+			"holding the time at which each counter was first collected or last reset",
+		defaultVal: false,
+	},
+	"minInterval": {
+		description: "In milliseconds. The scrapes happening within this duration after the commands were run " +
+			"reuse their results instead of running the commands again",
+		defaultVal: 0,
+	},
+	"templates": {
+		description: "Render the help, the label values and the commands of the metrics as Go templates, " +
+			"using {{ .Exporter }}, {{ .Hostname }} and the functions env, lower and shellquote. Always enabled for probes and for the metrics with a foreach",
+		defaultVal: false,
+	},
+	"probe": {
+		description: "Turns the exporter into a probe, whose commands are templates run against the target " +
+			"given by the 'target' query parameter of each scrape, e.g., {{ .Target }}. The help and the label values are also templates",
+	},
+	"probe.params": {
+		description: "The query parameters, besides 'target', which the commands can use, e.g., {{ .Params.module }}. " +
+			"The values are substituted shell-quoted",
+	},
+	"metrics": {
+		description: "An array of metrics to be generated",
+		required:    true,
+	},
+	"metrics.name": {
+		description: "The published name of the metric",
+		required:    true,
+	},
+	"metrics.help": {
+		description: "The published help message of the metric",
+		required:    true,
+	},
+	"metrics.type": {
+		description: "The Prometheus type of the metric",
+		required:    true,
+		enum:        supportedMetricTypes,
+	},
+	"metrics.foreach": {
+		description: "Generates the executions of the metric for each item of a list, " +
+			"which the templates of the command and the labels get as {{ .Item }}",
+	},
+	"metrics.foreach.items": {
+		description: "The items. Cannot be used with command",
+	},
+	"metrics.foreach.command": {
+		description: "A command run at each scrape, whose output gives the items, one per line. " +
+			"The items are substituted shell-quoted in the commands. Cannot be used with items",
+	},
+	"metrics.foreach.type": {
+		description: "The shell used to run the command giving the items",
+		defaultVal:  defaultExecutionType,
+		enum:        supportedShells,
+	},
+	"metrics.foreach.timeout": {
+		description: "Timeout in milliseconds for the command giving the items. 0 means no timeout",
+		defaultVal:  defaultTimeout,
+	},
+	"metrics.cacheTTL": {
+		description: "The results of the executions of the metric, and the items discovered by its foreach, " +
+			"are reused by the scrapes for this duration in milliseconds, unless the executions set their own. 0 means no cache",
+	},
+	"metrics.staleWhileRevalidate": {
+		description: "Serves the expired results while the executions are run again in the background, " +
+			"unless the executions set their own",
+	},
+	"metrics.executions": {
+		description: "An array of executions to generate the metric",
+		required:    true,
+	},
+	"metrics.executions.type": {
+		description: "The shell used to run the command, whose syntax must be compatible with it, " +
+			"or 'expression' to compute the value from other executions",
+		defaultVal: defaultExecutionType,
+		enum:       supportedExecutionTypes,
+	},
+	"metrics.executions.id": {
+		description: "Identifies the execution, so that the expressions of the exporter can use its value",
+	},
+	"metrics.executions.command": {
+		description: "The command that will be run exactly as-specified. Its result must be the single number to be used in the metric. " +
+			"For the type 'expression', an arithmetic expression using the ids of other executions, e.g., all - used",
+		required: true,
+	},
+	"metrics.executions.timeout": {
+		description: "Timeout in milliseconds for the command execution. 0 means no timeout",
+		defaultVal:  defaultTimeout,
+	},
+	"metrics.executions.labels": {
+		description: "A map of label to value. Mandatory if there is more than one execution for the metric",
+	},
+	"metrics.executions.valueFrom": {
+		description: "What gives the value of the metric: the output of the command, its exit code, " +
+			"its duration in seconds, or the number of lines or bytes of its output",
+		defaultVal: defaultValueFrom,
+		enum:       supportedValueSources,
+	},
+	"metrics.executions.valueMap": {
+		description: "Maps the output of the command, once trimmed, to the value of the metric, " +
+			"e.g., {active: 1, inactive: 0}. The output which is not mapped must be a number, unless defaultValue is set",
+	},
+	"metrics.executions.defaultValue": {
+		description: "The value of the metric when the output of the command is not in valueMap",
+	},
+	"metrics.executions.timestampFrom": {
+		description: "What gives the timestamp of the samples: the time of the scrape, or the last word of the output " +
+			"of the command, after the value, as seconds since the epoch (not milliseconds) or in RFC 3339 format. " +
+			"The timestamps more than a day in the future fail the execution",
+		defaultVal: defaultTimestampFrom,
+		enum:       supportedTimestampSources,
+	},
+	"metrics.executions.cacheTTL": {
+		description: "The result of the execution is reused by the scrapes for this duration in milliseconds. " +
+			"Defaults to the one of the metric. 0 means no cache",
+	},
+	"metrics.executions.staleWhileRevalidate": {
+		description: "Serves the expired result while the execution is run again in the background, " +
+			"instead of waiting for it. Defaults to the one of the metric",
+	},
+	"metrics.executions.retries": {
+		description: "The number of times a failed execution is run again during a scrape",
+	},
+	"metrics.executions.retryDelay": {
+		description: "The delay in milliseconds before the first retry, doubled for each next retry",
+	},
+	"metrics.executions.circuitBreaker": {
+		description: "Skips the execution for a while once it failed too many times in a row. " +
+			"The state of the circuit is exposed by the custom_exporter_circuit_breaker_open metric",
+	},
+	"metrics.executions.circuitBreaker.failures": {
+		description: "The number of consecutive failures opening the circuit",
+		required:    true,
+	},
+	"metrics.executions.circuitBreaker.openDuration": {
+		description: "The duration in milliseconds during which the execution is skipped once the circuit is open, " +
+			"after which it is tried again",
+		required: true,
+	},
+	"metrics.executions.transform": {
+		description: "Converts the value, applying the fields in the following order",
+	},
+	"metrics.executions.transform.parse": {
+		description: "Parses the output as a human-readable size (e.g., 1.5G), giving bytes, " +
+			"or as a duration (e.g., 3h2m), giving seconds",
+		enum: supportedParsers,
+	},
+	"metrics.executions.transform.fromUnit": {
+		description: "The unit of the value, which is converted to bytes, seconds or a ratio",
+		enum:        supportedUnits,
+	},
+	"metrics.executions.transform.multiply": {
+		description: "Multiplies the value",
+	},
+	"metrics.executions.transform.divide": {
+		description: "Divides the value",
+	},
+	"metrics.executions.transform.offset": {
+		description: "Adds to the value",
+		defaultVal:  0,
+	},
+	"metrics.executions.transform.abs": {
+		description: "Uses the absolute value",
+		defaultVal:  false,
+	},
+	"metrics.executions.transform.min": {
+		description: "The minimum of the value, which is raised to it",
+	},
+	"metrics.executions.transform.max": {
+		description: "The maximum of the value, which is lowered to it",
+	},
+	"metrics.executions.transform.round": {
+		description: "The number of decimals to round the value to",
+	},
+}
+
+// yamlFieldName returns the name used in the YAML file for a field of a
+// configuration structure, following the same rules as the yaml package
+func yamlFieldName(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("yaml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(field.Name)
+}
+
+func schemaForType(t reflect.Type, path string) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			// The unexported fields are not part of the configuration file
+			if field.PkgPath != "" {
+				continue
+			}
+			name := yamlFieldName(field)
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+
+			property := schemaForType(field.Type, fieldPath)
+			if info, ok := schemaProperties[fieldPath]; ok {
+				property["description"] = info.description
+				if info.defaultVal != nil {
+					property["default"] = info.defaultVal
+				}
+				if len(info.enum) > 0 {
+					property["enum"] = info.enum
+				}
+				if info.required {
+					required = append(required, name)
+				}
+			}
+			properties[name] = property
+		}
+
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaForType(t.Elem(), path),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaForType(t.Elem(), path),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// Schema returns the JSON Schema describing the format of an exporter
+// configuration file.  It is generated from the ExporterConfig structure
+// so that it always matches what ParseConfig accepts.
+func Schema() ([]byte, error) {
+	schema := schemaForType(reflect.TypeOf(ExporterConfig{}), "")
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = schemaID
+	schema["title"] = "Custom Prometheus Exporter configuration"
+	schema["description"] = "The definition of an exporter for the Custom Prometheus Exporter"
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,64 @@
+package configparser
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const publishedSchema = "../schema/exporter-config.schema.json"
+
+// configFieldPaths returns the path of every field of the configuration,
+// in the format used as key of schemaProperties
+func configFieldPaths(t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var paths []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldPath := yamlFieldName(field)
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+		paths = append(paths, fieldPath)
+		paths = append(paths, configFieldPaths(field.Type, fieldPath)...)
+	}
+	return paths
+}
+
+func TestSchemaDocumentsAllFields(t *testing.T) {
+	paths := configFieldPaths(reflect.TypeOf(ExporterConfig{}), "")
+	for _, path := range paths {
+		_, ok := schemaProperties[path]
+		assert.Assert(t, ok, "Field '"+path+"' is not documented in schemaProperties")
+	}
+
+	assert.Equal(t, len(schemaProperties), len(paths), "schemaProperties documents fields which do not exist")
+}
+
+func TestSchemaDefaults(t *testing.T) {
+	assert.Equal(t, schemaProperties["endpoint"].defaultVal, "/metrics")
+	assert.Equal(t, schemaProperties["metrics.executions.timeout"].defaultVal, uint(1000))
+	assert.Equal(t, schemaProperties["metrics.executions.type"].defaultVal, "bash")
+}
+
+func TestPublishedSchemaUpToDate(t *testing.T) {
+	schema, err := Schema()
+	assert.NilError(t, err)
+
+	published, err := ioutil.ReadFile(publishedSchema)
+	assert.NilError(t, err)
+
+	assert.Equal(t, string(published), string(schema),
+		"The published schema is out of date, regenerate it using: go run . schema > schema/exporter-config.schema.json")
+}
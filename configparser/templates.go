@@ -0,0 +1,168 @@
+package configparser
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateData is the data given to the templates of an exporter
+type templateData struct {
+	// The name of the exporter
+	Exporter string
+	Hostname string
+	// The target and the query parameters of the scrape, for probes
+	Target string
+	Params map[string]string
+	// The item of the 'foreach' of the metric
+	Item string
+	// Set if the item is discovered by a command, and is quoted like
+	// the values coming from the scrape
+	discovered bool
+}
+
+// The functions available to the templates, besides the builtin ones
+var templateFuncs = template.FuncMap{
+	"shellquote": shellQuote,
+	"lower":      strings.ToLower,
+	"env":        os.Getenv,
+}
+
+// shellQuote quotes a value so that any shell supported by the executions reads it
+// as a single word, whatever characters it contains
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// newTemplateData returns the data of the templates of an exporter, for a
+// probe target and its parameters if the exporter is a probe
+func newTemplateData(exporter *ExporterConfig, target string, params map[string]string) templateData {
+	hostname, _ := os.Hostname()
+	return templateData{
+		Exporter: exporter.Name,
+		Hostname: hostname,
+		Target:   target,
+		Params:   params,
+	}
+}
+
+// shellQuoted returns the data given to the templates of the commands, where the
+// values coming from the scrape or from a discovery command are shell-quoted so
+// that they are always substituted as a single argument
+func (d templateData) shellQuoted() templateData {
+	quoted := d
+	if d.discovered {
+		quoted.Item = shellQuote(d.Item)
+	}
+	quoted.Target = shellQuote(d.Target)
+	quoted.Params = map[string]string{}
+	for name, value := range d.Params {
+		quoted.Params[name] = shellQuote(value)
+	}
+	return quoted
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+func renderTemplate(name string, text string, data templateData) (string, error) {
+	tmpl, err := parseTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// renderExecution returns a copy of an execution whose command and label values are
+// rendered.  The location of the execution in the configuration is given for the errors.
+func renderExecution(execution ExecutionConfig, data templateData, location string) (ExecutionConfig, error) {
+	var err error
+	if execution.Command, err = renderTemplate("command", execution.Command, data.shellQuoted()); err != nil {
+		return execution, errors.New("Invalid template for field 'command' in " + location + ": " + err.Error())
+	}
+
+	if execution.Labels != nil {
+		labels := make(map[string]string, len(execution.Labels))
+		for name, value := range execution.Labels {
+			if labels[name], err = renderTemplate("labels", value, data); err != nil {
+				return execution, errors.New("Invalid template for label '" + name + "' in " + location + ": " + err.Error())
+			}
+		}
+		execution.Labels = labels
+	}
+	return execution, nil
+}
+
+// renderMetrics returns a copy of the metrics whose help, label values and commands
+// are rendered as templates, for all the metrics or only for the ones with a 'foreach'.
+// The executions of a 'foreach' are generated for each of its items, unless the items
+// are discovered at each scrape, in which case they are only verified, including that
+// their labels tell apart two different items.
+func renderMetrics(metrics []MetricsConfig, data templateData, all bool) ([]MetricsConfig, error) {
+	rendered := make([]MetricsConfig, len(metrics))
+	for i, metric := range metrics {
+		rendered[i] = metric
+		if !all && metric.Foreach == nil {
+			continue
+		}
+
+		// The help of a 'foreach' metric is rendered like its executions, without an item
+		if all || metric.Foreach != nil {
+			var err error
+			if rendered[i].Help, err = renderTemplate("help", metric.Help, data); err != nil {
+				return nil, errors.New("Invalid template for field 'help' in 'metrics' configuration of metric " +
+					strconv.Itoa(i) + ": " + err.Error())
+			}
+		}
+
+		items := []string{""}
+		if metric.Foreach != nil {
+			items = metric.Foreach.Items
+			if metric.Foreach.Command != "" {
+				// Keep the data for rendering the executions once the items are discovered
+				foreach := *metric.Foreach
+				foreach.data = data
+				rendered[i].Foreach = &foreach
+				items = []string{"item1", "item2"}
+			}
+		}
+
+		var executions []ExecutionConfig
+		for _, item := range items {
+			itemData := data
+			itemData.Item = item
+			itemData.discovered = metric.Foreach != nil && metric.Foreach.Command != ""
+			for j, execution := range metric.Executions {
+				execution, err := renderExecution(execution, itemData,
+					"'executions' configuration of metric "+strconv.Itoa(i)+" and execution "+strconv.Itoa(j))
+				if err != nil {
+					return nil, err
+				}
+				executions = append(executions, execution)
+			}
+		}
+
+		if metric.Foreach == nil || metric.Foreach.Command == "" {
+			rendered[i].Executions = executions
+			continue
+		}
+
+		// Otherwise the series of the discovered items would overwrite each other
+		for n := len(metric.Executions); n < len(executions); n++ {
+			if err := verifyLabels(executions, n); err != nil {
+				return nil, errors.New("Labels do not tell apart the discovered items, using {{ .Item }}, in " +
+					"'executions' configuration of metric " + strconv.Itoa(i) + " and execution " +
+					strconv.Itoa(n-len(metric.Executions)))
+			}
+		}
+	}
+	return rendered, nil
+}
@@ -0,0 +1,87 @@
+package configparser
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ExporterTests is the structure of a file defining the tests of an exporter
+type ExporterTests struct {
+	// All fields below must be exported (start with a capital letter)
+	// so that the yaml.UnmarshalStrict() method can set them.
+
+	// The name of the exporter being tested
+	Exporter string
+	Tests    []ExporterTest
+}
+
+// ExporterTest is a single test of an exporter, where the commands of the
+// executions are replaced by stubs
+type ExporterTest struct {
+	Name  string
+	Stubs []CommandStub
+	// The metrics expected to be produced, in the Prometheus text format
+	Expected string
+	// If specified, only the metrics with these names are compared
+	Metrics []string
+	// The target and the parameters of the scrape, if the exporter is a probe
+	Target string
+	Params map[string]string
+}
+
+// CommandStub provides the result of a command instead of running it
+type CommandStub struct {
+	// The command being replaced, exactly as it appears in the exporter configuration
+	Command  string
+	Stdout   string
+	Stderr   string
+	ExitCode int `yaml:"exitCode"`
+}
+
+func verifyExporterTests(tests *ExporterTests) error {
+	if tests.Exporter == "" {
+		return errors.New("Missing field 'exporter' in top configuration")
+	}
+
+	if len(tests.Tests) == 0 {
+		return errors.New("Missing field 'tests' in top configuration")
+	}
+
+	for i, test := range tests.Tests {
+		if test.Name == "" {
+			return errors.New("Missing field 'name' in 'tests' configuration of test " + strconv.Itoa(i))
+		}
+
+		if test.Expected == "" {
+			return errors.New("Missing field 'expected' in 'tests' configuration of test " + strconv.Itoa(i))
+		}
+
+		for j, stub := range test.Stubs {
+			if stub.Command == "" {
+				return errors.New("Missing field 'command' in 'stubs' configuration of test " + strconv.Itoa(i) +
+					" and stub " + strconv.Itoa(j))
+			}
+		}
+	}
+	return nil
+}
+
+// ParseTestsFile parses a YAML file defining the tests of an exporter
+func ParseTestsFile(file string) (ExporterTests, error) {
+	tests := ExporterTests{}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return tests, err
+	}
+
+	if err = yaml.UnmarshalStrict(data, &tests); err != nil {
+		return tests, err
+	}
+
+	err = verifyExporterTests(&tests)
+	return tests, err
+}
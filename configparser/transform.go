@@ -0,0 +1,174 @@
+package configparser
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+var (
+	supportedParsers = []string{"size", "duration"}
+
+	// The factor converting each unit to the base unit of its quantity, as
+	// required by the Prometheus naming conventions: bytes, seconds and ratios
+	unitFactors = map[string]float64{
+		"B":       1,
+		"KB":      1e3,
+		"MB":      1e6,
+		"GB":      1e9,
+		"TB":      1e12,
+		"PB":      1e15,
+		"KiB":     1 << 10,
+		"MiB":     1 << 20,
+		"GiB":     1 << 30,
+		"TiB":     1 << 40,
+		"PiB":     1 << 50,
+		"ns":      1e-9,
+		"us":      1e-6,
+		"ms":      1e-3,
+		"s":       1,
+		"m":       60,
+		"h":       3600,
+		"d":       86400,
+		"percent": 0.01,
+	}
+	supportedUnits = []string{"B", "KB", "MB", "GB", "TB", "PB", "KiB", "MiB", "GiB", "TiB", "PiB",
+		"ns", "us", "ms", "s", "m", "h", "d", "percent"}
+
+	// The suffixes of the human-readable sizes, in lower case.  Without a B, the
+	// suffixes are powers of 1024, like the -h option of ls, du and df.
+	sizeSuffixes = map[string]float64{
+		"": 1, "b": 1,
+		"k": 1 << 10, "ki": 1 << 10, "kib": 1 << 10, "kb": 1e3,
+		"m": 1 << 20, "mi": 1 << 20, "mib": 1 << 20, "mb": 1e6,
+		"g": 1 << 30, "gi": 1 << 30, "gib": 1 << 30, "gb": 1e9,
+		"t": 1 << 40, "ti": 1 << 40, "tib": 1 << 40, "tb": 1e12,
+		"p": 1 << 50, "pi": 1 << 50, "pib": 1 << 50, "pb": 1e15,
+	}
+	sizeRegexp = regexp.MustCompile(`^([0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)\s*([a-zA-Z]*)$`)
+)
+
+// TransformConfig converts the value of an execution, applying its
+// fields in the order in which they are declared
+type TransformConfig struct {
+	// All fields below must be exported (start with a capital letter)
+	// so that the yaml.UnmarshalStrict() method can set them.
+
+	// Parses the output of the command as a human-readable size or duration,
+	// giving bytes or seconds, instead of as a number
+	Parse string
+	// The unit of the value, which is converted to the base unit of its quantity
+	FromUnit string `yaml:"fromUnit"`
+	// Pointers so we can check for nil (missing)
+	Multiply *float64
+	Divide   *float64
+	Offset   float64
+	Abs      bool
+	Min      *float64
+	Max      *float64
+	// The number of decimals to round the value to
+	Round *uint
+}
+
+// verifyTransformConfig makes sure the conversions of the value of an execution are valid
+func verifyTransformConfig(execution *ExecutionConfig, location string) error {
+	transform := execution.Transform
+	if transform.Parse != "" {
+		if !contains(supportedParsers, transform.Parse) {
+			return errors.New("Wrong value for field 'parse' in 'transform' of " + location +
+				". Supported values are: size or duration")
+		}
+		if execution.ValueFrom != defaultValueFrom || execution.ExecutionType == expressionExecutionType {
+			return errors.New("Field 'parse' can only be used with 'valueFrom: stdout' in 'transform' of " + location)
+		}
+	}
+
+	if transform.FromUnit != "" && !contains(supportedUnits, transform.FromUnit) {
+		return errors.New("Wrong value for field 'fromUnit' in 'transform' of " + location +
+			". Supported values are: " + strings.Join(supportedUnits, ", "))
+	}
+
+	if transform.Divide != nil && *transform.Divide == 0 {
+		return errors.New("Field 'divide' cannot be 0 in 'transform' of " + location)
+	}
+
+	if transform.Min != nil && transform.Max != nil && *transform.Min > *transform.Max {
+		return errors.New("Field 'min' cannot be greater than field 'max' in 'transform' of " + location)
+	}
+	return nil
+}
+
+// ParseOutput parses the output of a command, once trimmed, as a number, or as
+// a human-readable size or duration if the transformation specifies it
+func (t *TransformConfig) ParseOutput(output string) (float64, error) {
+	switch t.Parse {
+	case "size":
+		return parseSize(output)
+	case "duration":
+		return parseDuration(output)
+	default:
+		return strconv.ParseFloat(output, 64)
+	}
+}
+
+// parseSize parses a human-readable size, such as 1.5G or 300 MiB, and returns it in bytes
+func parseSize(output string) (float64, error) {
+	match := sizeRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return 0, errors.New("invalid size '" + output + "'")
+	}
+
+	factor, ok := sizeSuffixes[strings.ToLower(match[2])]
+	if !ok {
+		return 0, errors.New("unknown unit '" + match[2] + "' in size '" + output + "'")
+	}
+
+	value, err := strconv.ParseFloat(match[1], 64)
+	return value * factor, err
+}
+
+// parseDuration parses a duration, such as 3h2m, 1.5s or 2d, and returns it in seconds
+func parseDuration(output string) (float64, error) {
+	if duration, err := model.ParseDuration(output); err == nil {
+		return time.Duration(duration).Seconds(), nil
+	}
+
+	duration, err := time.ParseDuration(output)
+	if err != nil {
+		return 0, errors.New("invalid duration '" + output + "'")
+	}
+	return duration.Seconds(), nil
+}
+
+// Apply converts a value according to the transformation
+func (t *TransformConfig) Apply(value float64) float64 {
+	if t.FromUnit != "" {
+		value *= unitFactors[t.FromUnit]
+	}
+	if t.Multiply != nil {
+		value *= *t.Multiply
+	}
+	if t.Divide != nil {
+		value /= *t.Divide
+	}
+	value += t.Offset
+	if t.Abs {
+		value = math.Abs(value)
+	}
+	if t.Min != nil {
+		value = math.Max(value, *t.Min)
+	}
+	if t.Max != nil {
+		value = math.Min(value, *t.Max)
+	}
+	if t.Round != nil {
+		scale := math.Pow(10, float64(*t.Round))
+		value = math.Round(value*scale) / scale
+	}
+	return value
+}
@@ -0,0 +1,74 @@
+package configparser
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestTransformParseOutput(t *testing.T) {
+	for _, test := range []struct {
+		parse  string
+		output string
+		value  float64
+	}{
+		{"size", "1.5G", 1.5 * (1 << 30)},
+		{"size", "300 MiB", 300 * (1 << 20)},
+		{"size", "2kB", 2000},
+		{"size", "512", 512},
+		{"duration", "3h2m", 3*3600 + 2*60},
+		{"duration", "1.5s", 1.5},
+		{"duration", "2d", 2 * 86400},
+		{"", "42.5", 42.5},
+	} {
+		transform := TransformConfig{Parse: test.parse}
+		value, err := transform.ParseOutput(test.output)
+		assert.NilError(t, err, test.output)
+		assert.Equal(t, value, test.value, test.output)
+	}
+
+	_, err := (&TransformConfig{Parse: "size"}).ParseOutput("1.5X")
+	assert.ErrorContains(t, err, "unknown unit 'X'")
+	_, err = (&TransformConfig{Parse: "duration"}).ParseOutput("soon")
+	assert.ErrorContains(t, err, "invalid duration 'soon'")
+}
+
+func TestTransformApply(t *testing.T) {
+	float := func(value float64) *float64 { return &value }
+	decimals := uint(1)
+
+	assert.Equal(t, (&TransformConfig{FromUnit: "KiB"}).Apply(2), float64(2048))
+	assert.Equal(t, (&TransformConfig{FromUnit: "ms"}).Apply(250), 0.25)
+	assert.Equal(t, (&TransformConfig{FromUnit: "percent"}).Apply(50), 0.5)
+	assert.Equal(t, (&TransformConfig{Multiply: float(3), Divide: float(2), Offset: -1}).Apply(4), float64(5))
+	assert.Equal(t, (&TransformConfig{Offset: -10, Abs: true}).Apply(4), float64(6))
+	assert.Equal(t, (&TransformConfig{Min: float(0), Max: float(1)}).Apply(1.7), float64(1))
+	assert.Equal(t, (&TransformConfig{Min: float(0), Max: float(1)}).Apply(-3), float64(0))
+	assert.Equal(t, (&TransformConfig{Round: &decimals}).Apply(2.26), 2.3)
+}
+
+func TestTransformInvalid(t *testing.T) {
+	c := Config{MainListenAddress: ":9530"}
+	transform := func(fields string) error {
+		_, err := c.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: test_bytes
+  help: Some size
+  type: gauge
+  executions:
+  - type: sh
+    command: du -sh /var | cut -f1
+` + fields))
+		return err
+	}
+
+	assert.NilError(t, transform("    transform:\n      parse: size\n      round: 0\n"))
+	assert.ErrorContains(t, transform("    transform:\n      parse: number\n"),
+		"Wrong value for field 'parse' in 'transform' of 'executions' configuration of metric 0 and execution 0")
+	assert.ErrorContains(t, transform("    valueFrom: exitCode\n    transform:\n      parse: size\n"),
+		"Field 'parse' can only be used with 'valueFrom: stdout'")
+	assert.ErrorContains(t, transform("    transform:\n      fromUnit: KiB/s\n"), "Wrong value for field 'fromUnit'")
+	assert.ErrorContains(t, transform("    transform:\n      divide: 0\n"), "Field 'divide' cannot be 0")
+	assert.ErrorContains(t, transform("    transform:\n      min: 1\n      max: 0\n"), "Field 'min' cannot be greater than field 'max'")
+}
@@ -0,0 +1,323 @@
+// Package expression parses and evaluates the arithmetic expressions which
+// compute the value of a metric from the values of other executions
+package expression
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The functions an expression can use, taking any number of arguments
+var functions = map[string]func(args []float64) float64{
+	"min": func(args []float64) float64 {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result
+	},
+	"max": func(args []float64) float64 {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result
+	},
+	"sum": sum,
+	"avg": func(args []float64) float64 {
+		return sum(args) / float64(len(args))
+	},
+}
+
+func sum(args []float64) float64 {
+	result := 0.0
+	for _, arg := range args {
+		result += arg
+	}
+	return result
+}
+
+// Expression is a parsed expression, which can be evaluated many times
+type Expression struct {
+	root      node
+	variables []string
+}
+
+// node is an element of the tree of an expression
+type node interface {
+	evaluate(lookup func(name string) (float64, error)) (float64, error)
+}
+
+type number float64
+
+func (n number) evaluate(func(string) (float64, error)) (float64, error) {
+	return float64(n), nil
+}
+
+type variable string
+
+func (v variable) evaluate(lookup func(string) (float64, error)) (float64, error) {
+	return lookup(string(v))
+}
+
+type negation struct {
+	operand node
+}
+
+func (n negation) evaluate(lookup func(string) (float64, error)) (float64, error) {
+	value, err := n.operand.evaluate(lookup)
+	return -value, err
+}
+
+type binaryOperation struct {
+	operator    byte
+	left, right node
+}
+
+func (b binaryOperation) evaluate(lookup func(string) (float64, error)) (float64, error) {
+	left, err := b.left.evaluate(lookup)
+	if err != nil {
+		return 0, err
+	}
+	right, err := b.right.evaluate(lookup)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.operator {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	default:
+		// A division by zero gives +Inf, -Inf or NaN, which are valid values of a metric
+		return left / right, nil
+	}
+}
+
+type call struct {
+	function func([]float64) float64
+	args     []node
+}
+
+func (c call) evaluate(lookup func(string) (float64, error)) (float64, error) {
+	args := make([]float64, len(c.args))
+	for i, arg := range c.args {
+		value, err := arg.evaluate(lookup)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+	return c.function(args), nil
+}
+
+// parser is a recursive descent parser of the grammar:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = unary { ("*" | "/") unary }
+//	unary      = "-" unary | primary
+//	primary    = number | name | name "(" expression { "," expression } ")" | "(" expression ")"
+type parser struct {
+	text      string
+	position  int
+	variables []string
+}
+
+// Parse parses an expression using numbers, the names of variables, the + - * /
+// operators, parentheses, and the min, max, sum and avg functions
+func Parse(text string) (*Expression, error) {
+	p := &parser{text: text}
+	root, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.position < len(p.text) {
+		return nil, p.unexpected()
+	}
+	return &Expression{root: root, variables: p.variables}, nil
+}
+
+// Variables returns the names of the variables used by the expression
+func (e *Expression) Variables() []string {
+	return e.variables
+}
+
+// Evaluate computes the value of the expression, using lookup to get the value of the variables
+func (e *Expression) Evaluate(lookup func(name string) (float64, error)) (float64, error) {
+	return e.root.evaluate(lookup)
+}
+
+func (p *parser) skipSpaces() {
+	for p.position < len(p.text) && unicode.IsSpace(rune(p.text[p.position])) {
+		p.position++
+	}
+}
+
+// peek returns the next character which is not a space, or 0 at the end of the expression
+func (p *parser) peek() byte {
+	p.skipSpaces()
+	if p.position >= len(p.text) {
+		return 0
+	}
+	return p.text[p.position]
+}
+
+func (p *parser) unexpected() error {
+	if p.position >= len(p.text) {
+		return errors.New("Unexpected end of expression")
+	}
+	return errors.New("Unexpected character '" + string(p.text[p.position]) + "' at position " + strconv.Itoa(p.position+1))
+}
+
+func (p *parser) parseExpression() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		operator := p.peek()
+		if operator != '+' && operator != '-' {
+			return left, nil
+		}
+		p.position++
+
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOperation{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *parser) parseTerm() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		operator := p.peek()
+		if operator != '*' && operator != '/' {
+			return left, nil
+		}
+		p.position++
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOperation{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.peek() == '-' {
+		p.position++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negation{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.position++
+		inner, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.unexpected()
+		}
+		p.position++
+		return inner, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case isNameChar(c) && !(c >= '0' && c <= '9'):
+		return p.parseName()
+	default:
+		return nil, p.unexpected()
+	}
+}
+
+func (p *parser) parseNumber() (node, error) {
+	start := p.position
+	for p.position < len(p.text) && strings.IndexByte("0123456789.", p.text[p.position]) >= 0 {
+		p.position++
+	}
+	// An optional exponent, e.g., 1e6 or 2.5E-3
+	if p.position < len(p.text) && (p.text[p.position] == 'e' || p.text[p.position] == 'E') {
+		p.position++
+		if p.position < len(p.text) && (p.text[p.position] == '+' || p.text[p.position] == '-') {
+			p.position++
+		}
+		for p.position < len(p.text) && p.text[p.position] >= '0' && p.text[p.position] <= '9' {
+			p.position++
+		}
+	}
+
+	value, err := strconv.ParseFloat(p.text[start:p.position], 64)
+	if err != nil {
+		return nil, errors.New("Invalid number '" + p.text[start:p.position] + "' at position " + strconv.Itoa(start+1))
+	}
+	return number(value), nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (p *parser) parseName() (node, error) {
+	start := p.position
+	for p.position < len(p.text) && isNameChar(p.text[p.position]) {
+		p.position++
+	}
+	name := p.text[start:p.position]
+
+	if p.peek() != '(' {
+		p.variables = append(p.variables, name)
+		return variable(name), nil
+	}
+
+	function, ok := functions[name]
+	if !ok {
+		return nil, errors.New("Unknown function '" + name + "' at position " + strconv.Itoa(start+1))
+	}
+	p.position++
+
+	var args []node
+	if p.peek() == ')' {
+		return nil, errors.New("Function '" + name + "' requires at least one argument")
+	}
+	for {
+		arg, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		switch p.peek() {
+		case ',':
+			p.position++
+		case ')':
+			p.position++
+			return call{function: function, args: args}, nil
+		default:
+			return nil, p.unexpected()
+		}
+	}
+}
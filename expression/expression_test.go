@@ -0,0 +1,74 @@
+package expression
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func lookup(values map[string]float64) func(string) (float64, error) {
+	return func(name string) (float64, error) {
+		value, ok := values[name]
+		if !ok {
+			return 0, errors.New("Unknown variable " + name)
+		}
+		return value, nil
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	values := map[string]float64{"all": 10, "top_level": 4, "used": 3}
+	for text, expected := range map[string]float64{
+		"all - top_level":                6,
+		"2 + 3 * 4":                      14,
+		"(2 + 3) * 4":                    20,
+		"-all + 1":                       -9,
+		"10 - 4 - 3":                     3,
+		"used / all":                     0.3,
+		"1.5e2":                          150,
+		"min(all, top_level, used)":      3,
+		"max(all, used * 5)":             15,
+		"sum(all, top_level) / avg(2,4)": 14.0 / 3,
+	} {
+		e, err := Parse(text)
+		assert.NilError(t, err, text)
+		value, err := e.Evaluate(lookup(values))
+		assert.NilError(t, err, text)
+		assert.Assert(t, math.Abs(value-expected) < 1e-9, "%s = %v", text, value)
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	e, err := Parse("used / 0")
+	assert.NilError(t, err)
+	value, err := e.Evaluate(lookup(map[string]float64{"used": 1}))
+	assert.NilError(t, err)
+	assert.Assert(t, math.IsInf(value, 1))
+}
+
+func TestVariables(t *testing.T) {
+	e, err := Parse("max(a, b) - a * c")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, e.Variables(), []string{"a", "b", "a", "c"})
+
+	_, err = e.Evaluate(lookup(map[string]float64{"a": 1, "b": 2}))
+	assert.ErrorContains(t, err, "Unknown variable c")
+}
+
+func TestParseErrors(t *testing.T) {
+	for text, message := range map[string]string{
+		"":          "Unexpected end of expression",
+		"a +":       "Unexpected end of expression",
+		"a b":       "Unexpected character 'b' at position 3",
+		"(a + b":    "Unexpected end of expression",
+		"a % b":     "Unexpected character '%' at position 3",
+		"pow(a, 2)": "Unknown function 'pow' at position 1",
+		"min()":     "Function 'min' requires at least one argument",
+		"1.2.3":     "Invalid number '1.2.3' at position 1",
+	} {
+		_, err := Parse(text)
+		assert.ErrorContains(t, err, message, text)
+	}
+}
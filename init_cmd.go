@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const starterConfigTemplate = `# yaml-language-server: $schema=https://raw.githubusercontent.com/marckhouzam/custom-prometheus-exporter/master/schema/exporter-config.schema.json
+#
+# Exporter generated by 'custom-prometheus-exporter init'.
+# Run its commands once with:  custom-prometheus-exporter test -f <this file>
+# Validate it with:            custom-prometheus-exporter validate -f <this file>
+name: {{ yaml .Name }}
+{{- if .Port }}
+port: {{ .Port }}
+{{- else }}
+# port: 9550                  # Omitted to share the port of the main webserver
+{{- end }}
+# listenAddress: 127.0.0.1:9550
+                              # Instead of 'port', to listen on a single interface
+                              #   or on a Unix socket using unix:/path/to/socket
+endpoint: {{ yaml .Endpoint }}
+metrics:
+- name: {{ yaml .Metric }}
+                              # Must be a valid Prometheus metric name, see
+                              #   https://prometheus.io/docs/practices/naming/
+  help: {{ yaml .Help }}
+  type: gauge                 # Or counter, whose name must end with _total
+  executions:
+  - type: {{ .Shell }}
+                              # One of sh, bash, tcsh or zsh.  The command is run
+                              #   using '{{ .Shell }} -c', so it must use the syntax of
+                              #   that shell.  For example, tcsh does not support
+                              #   the $(...) syntax and only bash and zsh support
+                              #   the [[ ... ]] tests.
+    command: {{ yaml .Command }}
+                              # Must print a single number.  Shell pipes (|) are allowed.
+                              #   The YAML quoting is removed before the shell
+                              #   interprets the command, so the command can
+                              #   use its own quotes.
+    timeout: 1000             # In milliseconds
+    # labels:                 # Mandatory if there is more than one execution
+    #   label_name: value     #   and every execution must use the same label names
+`
+
+// initValues holds the values used to fill the starter configuration
+type initValues struct {
+	Name     string
+	Port     int
+	Endpoint string
+	Metric   string
+	Help     string
+	Shell    string
+	Command  string
+}
+
+// yamlValue formats a value so that it can be safely inserted in a YAML file
+func yamlValue(value string) string {
+	data, _ := yaml.Marshal(value)
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+// defaultMetricName proposes a metric name based on the name of the exporter
+func defaultMetricName(exporterName string) string {
+	return strings.NewReplacer("-", "_", ".", "_", " ", "_").Replace(exporterName) + "_value"
+}
+
+// prompt asks for a value, proposing the current one as the default
+func prompt(in *bufio.Reader, out io.Writer, question string, value string) string {
+	if value != "" {
+		fmt.Fprintf(out, "%s [%s]: ", question, value)
+	} else {
+		fmt.Fprintf(out, "%s: ", question)
+	}
+
+	answer, _ := in.ReadString('\n')
+	if answer = strings.TrimSpace(answer); answer != "" {
+		return answer
+	}
+	return value
+}
+
+// promptValues interactively asks for every value of the starter configuration
+func promptValues(in io.Reader, out io.Writer, values *initValues) {
+	reader := bufio.NewReader(in)
+
+	values.Name = prompt(reader, out, "Name of the exporter", values.Name)
+
+	port := ""
+	if values.Port != 0 {
+		port = strconv.Itoa(values.Port)
+	}
+	for {
+		port = prompt(reader, out, "Port of the exporter (empty to use the main port)", port)
+		if p, err := strconv.Atoi(port); port == "" || err == nil {
+			values.Port = p
+			break
+		}
+		fmt.Fprintln(out, "The port must be a number")
+		port = ""
+	}
+
+	values.Endpoint = prompt(reader, out, "Endpoint serving the metrics", values.Endpoint)
+	if values.Metric == "" {
+		values.Metric = defaultMetricName(values.Name)
+	}
+	values.Metric = prompt(reader, out, "Name of the metric", values.Metric)
+	values.Help = prompt(reader, out, "Description of the metric", values.Help)
+	values.Shell = prompt(reader, out, "Shell running the command (sh, bash, tcsh or zsh)", values.Shell)
+	values.Command = prompt(reader, out, "Command printing the value of the metric", values.Command)
+}
+
+// generateStarterConfig fills the starter configuration and makes sure
+// the result is a valid configuration
+func generateStarterConfig(values initValues, mainListenAddress string) ([]byte, error) {
+	if values.Metric == "" {
+		values.Metric = defaultMetricName(values.Name)
+	}
+	if values.Help == "" {
+		values.Help = values.Metric
+	}
+
+	tmpl := template.Must(template.New("init").Funcs(template.FuncMap{"yaml": yamlValue}).Parse(starterConfigTemplate))
+
+	var data bytes.Buffer
+	if err := tmpl.Execute(&data, values); err != nil {
+		return nil, err
+	}
+
+	config := configparser.Config{MainListenAddress: mainListenAddress}
+	if _, err := config.ParseExporter(data.Bytes()); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// runInitCommand writes a starter configuration for a new exporter
+func runInitCommand(args []string) {
+	var f = flag.NewFlagSet("init", flag.ExitOnError)
+
+	var values initValues
+	var output string
+	var interactive, force bool
+
+	f.StringVar(&values.Name, "name", "", "The name of the exporter")
+	f.IntVar(&values.Port, "port", 0, "The port of the exporter. Uses the main port if omitted")
+	f.StringVar(&values.Endpoint, "endpoint", "/metrics", "The endpoint serving the metrics")
+	f.StringVar(&values.Metric, "metric", "", "The name of the metric. Based on the name of the exporter if omitted")
+	f.StringVar(&values.Help, "description", "", "The help message of the metric")
+	f.StringVar(&values.Shell, "shell", "bash", "The shell running the command: sh, bash, tcsh or zsh")
+	f.StringVar(&values.Command, "command", "", "The command printing the value of the metric")
+	f.StringVar(&output, "o", "", "The file to write. Defaults to <name>.yaml, use - for the standard output")
+	f.BoolVar(&interactive, "i", false, "Interactively ask for each value")
+	f.BoolVar(&force, "force", false, "Overwrite the file if it already exists")
+
+	f.Parse(args)
+
+	if interactive {
+		promptValues(os.Stdin, os.Stdout, &values)
+	}
+
+	if values.Name == "" || values.Command == "" {
+		fmt.Println("You must specify at least the name of the exporter and a command, or use -i.")
+		fmt.Println()
+		f.Usage()
+		os.Exit(1)
+	}
+
+	data, err := generateStarterConfig(values, defaultListenAddress)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error generating configuration:", err)
+		os.Exit(1)
+	}
+
+	if output == "-" {
+		os.Stdout.Write(data)
+		return
+	}
+
+	if output == "" {
+		output = values.Name + ".yaml"
+	}
+
+	if _, err := os.Stat(output); err == nil && !force {
+		fmt.Fprintln(os.Stderr, "File", output, "already exists. Use -force to overwrite it.")
+		os.Exit(1)
+	}
+
+	if err := ioutil.WriteFile(output, data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing configuration:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Configuration of exporter", values.Name, "written to", output)
+}
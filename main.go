@@ -4,7 +4,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
 	"github.com/marckhouzam/custom-prometheus-exporter/webservers"
@@ -12,6 +17,20 @@ import (
 
 const defaultMainPort int = 9530 // Reserved at https://github.com/prometheus/prometheus/wiki/Default-port-allocations
 
+// The main webserver listens on all interfaces by default
+var defaultListenAddress = net.JoinHostPort("", strconv.Itoa(defaultMainPort))
+
+// Changes to the configuration files are only taken into account once no
+// other change happened for this duration, to avoid reloading on every
+// intermediate write
+const configWatchDebounce = 2 * time.Second
+
+// Kubernetes gives pods 30 seconds to terminate by default
+const defaultShutdownGracePeriod = 20 * time.Second
+
+// Leaves time to send the response before the scrape times out
+const defaultScrapeTimeoutOffset = 500 * time.Millisecond
+
 // Support for flags that fill an array, this allows to pass the same
 // flag multiple times at the command line, for example to specify
 // multiple configuration files
@@ -28,41 +47,157 @@ func (a *arrayFlag) Set(str string) error {
 
 // End arrayFlag
 
-func parseFlags() (int, []string) {
-	// Use a new flag set to allow tests to call this method more than once
-	var f = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+// portFlag supports the deprecated -p flag, which listens on
+// the given port on all interfaces
+type portFlag struct {
+	listenAddress *string
+}
 
-	var port int
-	var configFiles = arrayFlag{}
+func (p portFlag) String() string {
+	return ""
+}
 
-	f.IntVar(&port, "p", defaultMainPort, "The main http port for the global custom-prometheus-exporter")
-	f.Var(&configFiles, "f", "A configuration file defining some exporters.\n"+
-		"This flag can be used multiple times to include multiple files.")
+func (p portFlag) Set(str string) error {
+	port, err := strconv.Atoi(str)
+	if err != nil {
+		return err
+	}
+	*p.listenAddress = net.JoinHostPort("", strconv.Itoa(port))
+	return nil
+}
 
-	f.Parse(os.Args[1:])
+// End portFlag
+
+// addConfigFlags defines the flags specifying the configuration on a flag set
+func addConfigFlags(f *flag.FlagSet, listenAddress *string, webConfigFile *string, configFiles *arrayFlag) {
+	f.StringVar(listenAddress, "web.listen-address", defaultListenAddress,
+		"The address of the main webserver of the global custom-prometheus-exporter,\n"+
+			"either [host]:port or unix:<path> for a Unix socket")
+	f.Var(portFlag{listenAddress}, "p", "Deprecated, use -web.listen-address instead.\n"+
+		"The main http port for the global custom-prometheus-exporter")
+	f.StringVar(webConfigFile, "web.config.file", "", "A web configuration file enabling TLS and basic authentication\n"+
+		"on the main webserver and, by default, on every exporter")
+	f.Var(configFiles, "f", "A configuration file defining some exporters.\n"+
+		"This flag can be used multiple times to include multiple files.")
+}
 
+// checkConfigFlags exits if no configuration file was specified
+func checkConfigFlags(f *flag.FlagSet, configFiles arrayFlag) {
 	if len(configFiles) == 0 {
 		fmt.Println("You must specify at least one configuration file.")
 		fmt.Println()
 		f.Usage()
 		os.Exit(1)
 	}
+}
+
+// options holds the values of the flags of the main command
+type options struct {
+	listenAddress       string
+	webConfigFile       string
+	configFiles         []string
+	watchConfig         bool
+	shutdownGracePeriod time.Duration
+	scrapeTimeoutOffset time.Duration
+}
+
+func parseFlags() options {
+	// Use a new flag set to allow tests to call this method more than once
+	var f = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	var opts options
+	var configFiles = arrayFlag{}
+
+	addConfigFlags(f, &opts.listenAddress, &opts.webConfigFile, &configFiles)
+	f.BoolVar(&opts.watchConfig, "watch", true, "Reload the configuration automatically when a configuration file changes")
+	f.DurationVar(&opts.shutdownGracePeriod, "shutdown-grace-period", defaultShutdownGracePeriod,
+		"The maximum time given to the scrapes in progress to complete when shutting down,\n"+
+			"after which the commands still running are terminated")
+	f.DurationVar(&opts.scrapeTimeoutOffset, "scrape-timeout-offset", defaultScrapeTimeoutOffset,
+		"Subtracted from the scrape timeout given by Prometheus to obtain the time after which\n"+
+			"the commands of a scrape are interrupted")
+
+	f.Parse(os.Args[1:])
+
+	checkConfigFlags(f, configFiles)
+	opts.configFiles = configFiles
+
+	return opts
+}
 
-	return port, configFiles
+// handleTerminationSignals gracefully shuts down on SIGTERM or SIGINT.
+// A second signal exits immediately.
+func handleTerminationSignals(gracePeriod time.Duration) {
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-term
+		log.Println("Received", sig.String()+", shutting down")
+		go webservers.Shutdown(gracePeriod)
+
+		sig = <-term
+		log.Println("Received", sig.String()+" again, exiting immediately")
+		os.Exit(1)
+	}()
+}
+
+// handleReloadSignal reloads the configuration whenever a SIGHUP is received
+func handleReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			log.Println("Received SIGHUP, reloading configuration")
+			if _, err := webservers.Reload(); err != nil {
+				log.Println("Reload failed!", err)
+			}
+		}
+	}()
 }
 
 func main() {
-	port, files := parseFlags()
+	// Sub-commands are given as the first argument
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "schema":
+			runSchemaCommand()
+			return
+		case "validate":
+			runValidateCommand(os.Args[2:])
+			return
+		case "test":
+			runTestCommand(os.Args[2:])
+			return
+		case "init":
+			runInitCommand(os.Args[2:])
+			return
+		}
+	}
+
+	opts := parseFlags()
 
 	config := configparser.Config{
-		MainPort:    port,
-		ConfigFiles: files,
+		MainListenAddress:   opts.listenAddress,
+		WebConfigFile:       opts.webConfigFile,
+		ScrapeTimeoutOffset: opts.scrapeTimeoutOffset,
+		ConfigFiles:         opts.configFiles,
 	}
 
 	if err := config.ParseConfig(); err != nil {
 		log.Fatal("Error parsing configuration: ", err)
 	}
 
-	// Blocks forever
+	handleReloadSignal()
+	handleTerminationSignals(opts.shutdownGracePeriod)
+
+	if opts.watchConfig {
+		if err := webservers.WatchConfigFiles(opts.configFiles, configWatchDebounce); err != nil {
+			log.Fatal("Error watching configuration files: ", err)
+		}
+	}
+
+	// Blocks until shutdown
 	webservers.CreateListenAndServe(config)
 }
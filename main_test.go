@@ -1,17 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"os"
 	"os/exec"
-	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
 	"gotest.tools/assert"
 )
 
 func runCrashingTest(t *testing.T, testCode func()) (outStr, errStr string) {
+	exitCode, outStr, errStr := runSubprocessTest(t, testCode)
+	if exitCode == 0 {
+		t.Fatal("process ran without an error, while we expected an error code")
+	}
+	return outStr, errStr
+}
+
+// runSubprocessTest runs the test code in a new process, so that exiting does not
+// stop the tests, and returns its exit code and output
+func runSubprocessTest(t *testing.T, testCode func()) (exitCode int, outStr, errStr string) {
 	crashEnvVarName := "RUN_CRASHING_CODE"
 	crashEnvVarValue := "1"
 
@@ -25,30 +36,32 @@ func runCrashingTest(t *testing.T, testCode func()) (outStr, errStr string) {
 		return
 	}
 
-	cmd := exec.Command(os.Args[0], "-test.run="+t.Name())
+	// Don't use os.Args[0] as some tests modify it
+	testBinary, err := os.Executable()
+	assert.NilError(t, err)
+
+	cmd := exec.Command(testBinary, "-test.run=^"+t.Name()+"$")
 	cmd.Env = append(os.Environ(), crashEnvVarName+"="+crashEnvVarValue)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 
-	var timedout bool
-	timer := time.AfterFunc(500*time.Millisecond, func() {
-		timedout = true
+	timer := time.AfterFunc(5*time.Second, func() {
 		cmd.Process.Kill()
 	})
-	defer timer.Stop()
 
-	bytes, err := cmd.Output()
+	out, err := cmd.Output()
 
-	if timedout {
+	// The timer already fired if it cannot be stopped
+	if !timer.Stop() {
 		t.Fatal("Timeout")
 		return
 	}
 
-	if e, ok := err.(*exec.ExitError); ok && !e.Success() {
-		return string(bytes), string(e.Stderr)
+	if e, ok := err.(*exec.ExitError); ok {
+		return e.ExitCode(), string(out), stderr.String()
 	}
-
-	t.Fatal("process ran without an error, while we expected an error code")
-
-	return
+	assert.NilError(t, err)
+	return 0, string(out), stderr.String()
 }
 
 func TestFlagsEmpty(t *testing.T) {
@@ -80,23 +93,187 @@ func TestFlagsValid(t *testing.T) {
 	validPortStr := "12345"
 	configFile := "example-configurations/test-exporter.yaml"
 
-	validPort, _ := strconv.Atoi(validPortStr)
-
 	os.Args = []string{".", "-p", validPortStr, "-f", configFile}
-	port, configFiles := parseFlags()
+	opts := parseFlags()
 
-	assert.Equal(t, port, validPort)
-	assert.Equal(t, len(configFiles), 1)
-	assert.Equal(t, configFiles[0], configFile)
+	assert.Equal(t, opts.listenAddress, ":"+validPortStr)
+	assert.Equal(t, len(opts.configFiles), 1)
+	assert.Equal(t, opts.configFiles[0], configFile)
 }
 
 func TestFlagsDefaultPort(t *testing.T) {
 	configFile := "example-configurations/test-exporter.yaml"
 
 	os.Args = []string{".", "-f", configFile}
-	port, configFiles := parseFlags()
+	opts := parseFlags()
+
+	assert.Equal(t, opts.listenAddress, ":9530")
+	assert.Equal(t, len(opts.configFiles), 1)
+	assert.Equal(t, opts.configFiles[0], configFile)
+	assert.Equal(t, opts.watchConfig, true)
+}
+
+func TestFlagsListenAddress(t *testing.T) {
+	os.Args = []string{".", "--web.listen-address", "unix:/run/exporter.sock", "-f", "example-configurations/test-exporter.yaml"}
+	opts := parseFlags()
+
+	assert.Equal(t, opts.listenAddress, "unix:/run/exporter.sock")
+}
+
+func TestFlagsNoWatch(t *testing.T) {
+	os.Args = []string{".", "-f", "example-configurations/test-exporter.yaml", "-watch=false"}
+	opts := parseFlags()
+
+	assert.Equal(t, opts.watchConfig, false)
+}
+
+func TestValidateCommandValid(t *testing.T) {
+	exitCode, out, errOut := runSubprocessTest(t, func() {
+		os.Args = []string{".", "validate",
+			"-f", "example-configurations/test-exporter.yaml",
+			"-f", "example-configurations/docker-exporter.yaml"}
+		main()
+	})
+	assert.Equal(t, exitCode, 0, "Error output: "+errOut)
+	assert.Assert(t, strings.Contains(out, "example-configurations/test-exporter.yaml: OK"), "Output: "+out)
+	assert.Assert(t, strings.Contains(out, "example-configurations/docker-exporter.yaml: OK"), "Output: "+out)
+}
+
+func TestValidateCommandCollision(t *testing.T) {
+	out, _ := runCrashingTest(t, func() {
+		os.Args = []string{".", "validate", "-o", "json",
+			"-f", "example-configurations/test-exporter.yaml",
+			"-f", "example-configurations/test-exporter.yaml"}
+		main()
+	})
+	assert.Assert(t, strings.Contains(out, `"valid": false`), "Output: "+out)
+	assert.Assert(t, strings.Contains(out, "Duplicate exporter name 'test-exporter'"), "Output: "+out)
+}
+
+func TestValidateCommandNoFile(t *testing.T) {
+	out, _ := runCrashingTest(t, func() {
+		os.Args = []string{".", "validate"}
+		main()
+	})
+	assert.Assert(t, strings.Contains(out, "must specify at least one configuration file"), "Output: "+out)
+}
+
+func TestTestExporter(t *testing.T) {
+	config := configparser.Config{ConfigFiles: []string{"example-configurations/test-exporter.yaml"}}
+	assert.NilError(t, config.ParseConfig())
+
+	// Only keep the executions using the sh shell, which is always available
+	exporterCfg := config.Exporters[0]
+	exporterCfg.Metrics = exporterCfg.Metrics[1:]
+
+	var out bytes.Buffer
+	assert.Assert(t, testExporter(&out, exporterCfg))
+	assert.Assert(t, strings.Contains(out.String(), `test_gauge_other_values{type="four-digit"} 4`), "Output: "+out.String())
+	assert.Assert(t, strings.Contains(out.String(), "#   command: echo 123 | wc -c"), "Output: "+out.String())
+}
+
+func TestTestExporterFailure(t *testing.T) {
+	config := configparser.Config{ConfigFiles: []string{"example-configurations/test-exporter.yaml"}}
+	assert.NilError(t, config.ParseConfig())
+
+	exporterCfg := config.Exporters[0]
+	exporterCfg.Metrics = exporterCfg.Metrics[1:]
+	exporterCfg.Metrics[0].Executions = exporterCfg.Metrics[0].Executions[:1]
+	exporterCfg.Metrics[0].Executions[0].Command = "echo failure >&2; exit 3"
+
+	var out bytes.Buffer
+	assert.Assert(t, !testExporter(&out, exporterCfg))
+	assert.Assert(t, strings.Contains(out.String(), "exit code 3"), "Output: "+out.String())
+	assert.Assert(t, strings.Contains(out.String(), "#   stderr: failure"), "Output: "+out.String())
+}
+
+func TestTestsFile(t *testing.T) {
+	config := configparser.Config{ConfigFiles: []string{"example-configurations/docker-exporter.yaml"}}
+	assert.NilError(t, config.ParseConfig())
+
+	var out bytes.Buffer
+	assert.Assert(t, runTestsFile(&out, config, "example-configurations/docker-exporter_test.yaml"), "Output: "+out.String())
+	assert.Assert(t, strings.Contains(out.String(), "--- PASS: docker-exporter/containers in every state"), "Output: "+out.String())
+}
+
+func TestTestsFileMismatch(t *testing.T) {
+	config := configparser.Config{ConfigFiles: []string{"example-configurations/docker-exporter.yaml"}}
+	assert.NilError(t, config.ParseConfig())
+
+	test := configparser.ExporterTest{
+		Name: "wrong value",
+		Stubs: []configparser.CommandStub{
+			{Command: "docker images --quiet | wc -l", Stdout: "3"},
+		},
+		Metrics: []string{"docker_image_types_images"},
+		Expected: `
+# HELP docker_image_types_images The count of images of various types
+# TYPE docker_image_types_images gauge
+docker_image_types_images{type="top-level"} 4
+`,
+	}
+
+	var out bytes.Buffer
+	assert.Assert(t, !runExporterTest(&out, config.Exporters[0], test))
+	assert.Assert(t, strings.Contains(out.String(), "--- FAIL: docker-exporter/wrong value"), "Output: "+out.String())
+	assert.Assert(t, strings.Contains(out.String(), `docker_image_types_images{type="top-level"} 3`), "Output: "+out.String())
+	assert.Assert(t, strings.Contains(out.String(), "No stub for command: docker images --quiet --filter dangling=true | wc -l"), "Output: "+out.String())
+}
+
+func TestInitStarterConfig(t *testing.T) {
+	values := initValues{
+		Name:     "disk-exporter",
+		Port:     9600,
+		Endpoint: "/metrics",
+		Shell:    "sh",
+		Command:  `df --output=pcent / | tail -1 | tr -d ' %'`,
+	}
+	data, err := generateStarterConfig(values, defaultListenAddress)
+	assert.NilError(t, err)
+
+	config := configparser.Config{MainListenAddress: defaultListenAddress}
+	exporterCfg, err := config.ParseExporter(data)
+	assert.NilError(t, err)
+	assert.Equal(t, exporterCfg.Port, 9600)
+	assert.Equal(t, exporterCfg.Metrics[0].Name, "disk_exporter_value")
+	assert.Equal(t, exporterCfg.Metrics[0].Executions[0].Command, values.Command)
+}
+
+func TestInitInvalidValues(t *testing.T) {
+	values := initValues{
+		Name:     "disk-exporter",
+		Endpoint: "/metrics",
+		Shell:    "fish",
+		Command:  "echo 1",
+	}
+	_, err := generateStarterConfig(values, defaultListenAddress)
+	assert.ErrorContains(t, err, "Wrong value for field 'type' in 'executions' configuration")
+}
+
+func TestInitInteractive(t *testing.T) {
+	values := initValues{Endpoint: "/metrics", Shell: "bash"}
+	in := strings.NewReader("my-exporter\nabc\n9600\n\nmy_metric\nSome help\nsh\necho 1\n")
+
+	var out bytes.Buffer
+	promptValues(in, &out, &values)
+
+	assert.Equal(t, values, initValues{
+		Name:     "my-exporter",
+		Port:     9600,
+		Endpoint: "/metrics",
+		Metric:   "my_metric",
+		Help:     "Some help",
+		Shell:    "sh",
+		Command:  "echo 1",
+	})
+	assert.Assert(t, strings.Contains(out.String(), "The port must be a number"), "Output: "+out.String())
+}
+
+func TestTestsFileProbe(t *testing.T) {
+	config := configparser.Config{ConfigFiles: []string{"example-configurations/http-probe.yaml"}}
+	assert.NilError(t, config.ParseConfig())
 
-	assert.Equal(t, port, defaultMainPort)
-	assert.Equal(t, len(configFiles), 1)
-	assert.Equal(t, configFiles[0], configFile)
+	var out bytes.Buffer
+	assert.Assert(t, runTestsFile(&out, config, "example-configurations/http-probe_test.yaml"), "Output: "+out.String())
+	assert.Assert(t, strings.Contains(out.String(), "--- PASS: http-probe/target found"), "Output: "+out.String())
 }
@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// lockedBuffer collects the logs written concurrently by the tested code
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestReloadSignal(t *testing.T) {
+	logs := &lockedBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	handleReloadSignal()
+	assert.NilError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		out := logs.String()
+		if strings.Contains(out, "Reload failed!") || strings.Contains(out, "Configuration reloaded") {
+			assert.Assert(t, strings.Contains(out, "Received SIGHUP, reloading configuration"), "Logs: "+out)
+			break
+		}
+		assert.Assert(t, time.Now().Before(deadline), "The configuration was not reloaded. Logs: "+out)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,168 @@
+package metricscollector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var circuitBreakerOpenDesc = prometheus.NewDesc(
+	"custom_exporter_circuit_breaker_open",
+	"Whether the execution is skipped because it failed too many times in a row",
+	[]string{"metric", "labels"}, nil,
+)
+
+// errCircuitOpen is the error of the executions skipped because their circuit
+// breaker is open, which is only logged when the circuit opens
+var errCircuitOpen = errors.New("Circuit breaker open")
+
+// circuitBreaker counts the consecutive failures of an execution
+type circuitBreaker struct {
+	metric string
+	labels string
+	// The number of consecutive failures of the execution
+	failures uint
+	// The time until which the execution is skipped
+	openUntil time.Time
+}
+
+// formatLabels formats the labels of an execution, sorted by name, such as for
+// the value of the labels label of custom_exporter_circuit_breaker_open
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// runWithRetries runs an execution, running it again if it fails until it succeeds
+// or its retries are exhausted, waiting longer before each retry.  If the execution
+// has a circuit breaker, it is skipped while its circuit is open.
+func (m *MetricsCollector) runWithRetries(ctx context.Context, metricName string, execution configparser.ExecutionConfig) ExecutionResult {
+	var breaker *circuitBreaker
+	if execution.CircuitBreaker != nil {
+		breaker = m.circuitBreaker(metricName, execution)
+
+		m.breakerMutex.Lock()
+		open := time.Now().Before(breaker.openUntil)
+		m.breakerMutex.Unlock()
+		if open {
+			return ExecutionResult{
+				Metric:   metricName,
+				Labels:   execution.Labels,
+				Command:  execution.Command,
+				ExitCode: -1,
+				Err:      fmt.Errorf("%w, skipping: %s", errCircuitOpen, execution.Command),
+			}
+		}
+	}
+
+	result := m.runExecution(ctx, metricName, execution)
+	delay := time.Duration(execution.RetryDelay) * time.Millisecond
+	for retry := uint(0); retry < execution.Retries && result.Err != nil; retry++ {
+		if errors.Is(result.Err, errScrapeCancelled) {
+			break
+		}
+		logExecutionError(result)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		delay *= 2
+		result = m.runExecution(ctx, metricName, execution)
+	}
+
+	if breaker != nil && !errors.Is(result.Err, errScrapeCancelled) {
+		m.breakerMutex.Lock()
+		defer m.breakerMutex.Unlock()
+
+		if result.Err == nil {
+			breaker.failures = 0
+			return result
+		}
+
+		// A failure after the circuit was open opens it again right away
+		breaker.failures++
+		if breaker.failures >= execution.CircuitBreaker.Failures {
+			openDuration := time.Duration(execution.CircuitBreaker.OpenDuration) * time.Millisecond
+			breaker.openUntil = time.Now().Add(openDuration)
+			log.Println("Circuit breaker opened for", openDuration, "after", breaker.failures,
+				"consecutive failures of:", execution.Command)
+		}
+	}
+	return result
+}
+
+// circuitBreaker returns the circuit breaker of an execution, creating it if needed
+func (m *MetricsCollector) circuitBreaker(metricName string, execution configparser.ExecutionConfig) *circuitBreaker {
+	m.breakerMutex.Lock()
+	defer m.breakerMutex.Unlock()
+
+	key := executionKey(metricName, execution)
+	breaker := m.breakers[key]
+	if breaker == nil {
+		if m.breakers == nil {
+			m.breakers = map[string]*circuitBreaker{}
+		}
+		breaker = &circuitBreaker{metric: metricName, labels: formatLabels(execution.Labels)}
+		m.breakers[key] = breaker
+	}
+	return breaker
+}
+
+// retainBreakers removes the circuit breakers of the executions of a metric which
+// are not among the given ones, such as the ones of the items no longer discovered
+func (m *MetricsCollector) retainBreakers(metricName string, executions []configparser.ExecutionConfig) {
+	m.breakerMutex.Lock()
+	defer m.breakerMutex.Unlock()
+
+	kept := map[string]bool{}
+	for _, execution := range executions {
+		kept[executionKey(metricName, execution)] = true
+	}
+	for key, breaker := range m.breakers {
+		if breaker.metric == metricName && !kept[key] {
+			delete(m.breakers, key)
+		}
+	}
+}
+
+// collectBreakers produces the state of the circuit breakers of the selected
+// metrics, or of every metric if none is selected
+func (m *MetricsCollector) collectBreakers(ch chan<- prometheus.Metric, metricNames []string) {
+	selected := map[string]bool{}
+	for _, name := range metricNames {
+		selected[name] = true
+	}
+
+	m.breakerMutex.Lock()
+	defer m.breakerMutex.Unlock()
+
+	now := time.Now()
+	for _, breaker := range m.breakers {
+		if len(selected) > 0 && !selected[breaker.metric] {
+			continue
+		}
+		open := 0.0
+		if now.Before(breaker.openUntil) {
+			open = 1
+		}
+		metric, err := prometheus.NewConstMetric(circuitBreakerOpenDesc, prometheus.GaugeValue, open, breaker.metric, breaker.labels)
+		if err != nil {
+			metric = prometheus.NewInvalidMetric(circuitBreakerOpenDesc, err)
+		}
+		ch <- metric
+	}
+}
@@ -0,0 +1,114 @@
+package metricscollector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+)
+
+// staleCacheRetention is how long an expired result which can be served stale is kept
+// after it was last used, whatever the interval between the scrapes using it
+const staleCacheRetention = time.Hour
+
+// cachedResult is the result of an execution, reused by the scrapes until it expires
+type cachedResult struct {
+	result  ExecutionResult
+	expires time.Time
+	ttl     time.Duration
+	// Set if the result is served once expired, while the execution is run again
+	stale bool
+	// The last time the result was returned
+	used time.Time
+	// Set while the execution is run again in the background
+	refreshing bool
+}
+
+// executionRunner runs an execution of a metric and returns its result
+type executionRunner func(ctx context.Context, metricName string, execution configparser.ExecutionConfig) ExecutionResult
+
+// executionKey identifies an execution of a metric, once its templates are rendered
+func executionKey(metricName string, execution configparser.ExecutionConfig) string {
+	// Printing a map sorts its keys
+	return fmt.Sprint(metricName, "\x00", execution.ExecutionType, "\x00", execution.Command, "\x00", execution.Labels)
+}
+
+// runCached returns the cached result of an execution if it has not expired, or runs the
+// execution and caches its result.  An expired result is returned as is while the execution
+// is run again in the background if the execution allows it.  Only the results without
+// errors are cached, so that the failures are reported by the next scrape.
+func (m *MetricsCollector) runCached(ctx context.Context, metricName string, execution configparser.ExecutionConfig,
+	run executionRunner) ExecutionResult {
+	if execution.CacheTTL == nil || *execution.CacheTTL == 0 {
+		return run(ctx, metricName, execution)
+	}
+	ttl := time.Duration(*execution.CacheTTL) * time.Millisecond
+	key := executionKey(metricName, execution)
+
+	stale := execution.StaleWhileRevalidate != nil && *execution.StaleWhileRevalidate
+
+	m.cacheMutex.Lock()
+	if cached := m.cache[key]; cached != nil {
+		cached.used = time.Now()
+		if time.Now().Before(cached.expires) {
+			m.cacheMutex.Unlock()
+			return cached.result
+		}
+
+		if stale {
+			if !cached.refreshing {
+				cached.refreshing = true
+				// The refresh outlives the scrape, so it is only interrupted by its timeout
+				go func() {
+					result := run(context.Background(), metricName, execution)
+					if result.Err != nil {
+						logExecutionError(result)
+					}
+					m.storeResult(key, ttl, stale, result)
+				}()
+			}
+			m.cacheMutex.Unlock()
+			return cached.result
+		}
+	}
+	m.cacheMutex.Unlock()
+
+	result := run(ctx, metricName, execution)
+	m.storeResult(key, ttl, stale, result)
+	return result
+}
+
+// storeResult caches the result of an execution, or forgets the cached one
+// if the execution failed.  The results which have not been used for a while,
+// such as the ones of the items no longer discovered, are dropped.  The ones
+// which can be served stale are kept longer, as the scrapes can be further apart
+// than their TTL.
+func (m *MetricsCollector) storeResult(key string, ttl time.Duration, stale bool, result ExecutionResult) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	now := time.Now()
+	for k, cached := range m.cache {
+		if cached.refreshing {
+			continue
+		}
+		if cached.stale {
+			if now.After(cached.used.Add(cached.ttl + staleCacheRetention)) {
+				delete(m.cache, k)
+			}
+		} else if now.After(cached.expires.Add(cached.ttl)) {
+			delete(m.cache, k)
+		}
+	}
+
+	if result.Err != nil {
+		delete(m.cache, key)
+		return
+	}
+
+	if m.cache == nil {
+		m.cache = map[string]*cachedResult{}
+	}
+	m.cache[key] = &cachedResult{result: result, expires: now.Add(ttl), ttl: ttl, stale: stale, used: now}
+}
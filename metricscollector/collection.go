@@ -0,0 +1,153 @@
+package metricscollector
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collection is a single run of the executions of the selected metrics, whose
+// results are shared by the scrapes happening while it is in progress
+type collection struct {
+	// The metrics whose executions are run, or nil for every metric
+	selected map[string]bool
+	// Closed once the collection has completed
+	done      chan struct{}
+	completed time.Time
+	// Set if some executions were interrupted or skipped
+	truncated bool
+	// The collection is not owned by any scrape, and is only cancelled once
+	// every scrape waiting for it has given up
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// selectionKey identifies a selection of metrics, regardless of their order
+func selectionKey(metricNames []string) string {
+	if len(metricNames) == 0 {
+		return ""
+	}
+	sorted := append([]string{}, metricNames...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// startCollection returns the collection a scrape selecting some metrics should use:
+// the one in progress, the last one if it completed less than minInterval ago, or a
+// new one, which is run in the background.  The caller waits for the collection and must
+// call leaveCollection afterwards.
+func (m *MetricsCollector) startCollection(metricNames []string) *collection {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := selectionKey(metricNames)
+	if c := m.collections[key]; c != nil {
+		select {
+		case <-c.done:
+			// A truncated collection is not reused, to get the missing values
+			if !c.truncated && time.Since(c.completed) < m.minInterval {
+				c.waiters++
+				return c
+			}
+		default:
+			// A cancelled collection is only completing with the values collected so far
+			if c.ctx.Err() == nil {
+				c.waiters++
+				return c
+			}
+		}
+	}
+
+	c := &collection{done: make(chan struct{}), waiters: 1}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if len(metricNames) > 0 {
+		c.selected = map[string]bool{}
+		for _, name := range metricNames {
+			c.selected[name] = true
+		}
+	}
+
+	if m.collections == nil {
+		m.collections = map[string]*collection{}
+	}
+	m.collections[key] = c
+	go m.run(c)
+	return c
+}
+
+// leaveCollection is called once a scrape no longer waits for a collection.  The last
+// scrape to leave a collection in progress cancels it, and waits for it to complete
+// with the values collected so far.
+func (m *MetricsCollector) leaveCollection(c *collection) {
+	m.mutex.Lock()
+	c.waiters--
+	last := c.waiters == 0
+	m.mutex.Unlock()
+
+	if last {
+		select {
+		case <-c.done:
+		default:
+			c.cancel()
+			<-c.done
+		}
+	}
+}
+
+// run runs the executions of a collection, interrupting them when it is cancelled
+func (m *MetricsCollector) run(c *collection) {
+	defer c.cancel()
+	results := m.getMetrics(c.ctx, c.selected)
+
+	truncated := 0
+	for _, result := range results {
+		if errors.Is(result.Err, errScrapeCancelled) {
+			truncated++
+		}
+	}
+	if truncated > 0 {
+		log.Println("Scrape cancelled:", truncated, "executions were interrupted or skipped:", c.ctx.Err())
+	}
+
+	m.mutex.Lock()
+	m.lastResults = results
+	c.truncated = truncated > 0
+	c.completed = time.Now()
+	m.mutex.Unlock()
+
+	close(c.done)
+}
+
+// collect produces the selected metrics, or every metric if none is selected,
+// running the executions only if no other scrape is already doing it.
+// It returns true if some executions were interrupted or skipped.
+func (m *MetricsCollector) collect(ctx context.Context, ch chan<- prometheus.Metric, metricNames []string) bool {
+	c := m.startCollection(metricNames)
+
+	// Wait for the collection in progress, but not past the deadline of this scrape,
+	// in which case the values collected so far are used
+	truncated := false
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		truncated = true
+	}
+	m.leaveCollection(c)
+
+	m.mutex.RLock()
+	truncated = truncated || c.truncated
+	m.mutex.RUnlock()
+
+	for i, vec := range m.metricVecs {
+		if c.selected == nil || c.selected[m.metricsConfig[i].Name] {
+			vec.Collect(ch)
+		}
+	}
+	return truncated
+}
@@ -1,14 +1,21 @@
 package metricscollector
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+	"github.com/marckhouzam/custom-prometheus-exporter/expression"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -16,7 +23,60 @@ import (
 type MetricsCollector struct {
 	mutex         sync.RWMutex
 	metricsConfig []configparser.MetricsConfig
-	gaugeVecs     []*prometheus.GaugeVec
+	metricVecs    []metricVec
+	lastResults   []ExecutionResult
+	runner        CommandRunner
+	// The collection in progress, or the last one, shared by the concurrent
+	// scrapes selecting the same metrics, by selection
+	collections map[string]*collection
+	// The results of a collection are reused by the scrapes happening
+	// within this duration after it completed
+	minInterval time.Duration
+	// The results of the executions having a cache, by execution
+	cacheMutex sync.Mutex
+	cache      map[string]*cachedResult
+	// The circuit breakers of the executions having one, by execution
+	breakerMutex sync.Mutex
+	breakers     map[string]*circuitBreaker
+	// The executions of type expression which have an id, by id
+	expressionsByID map[string]configparser.ExecutionConfig
+	// The names of the metrics whose executions the expressions of a metric use, by metric
+	dependencies map[string][]string
+}
+
+// CommandRunner runs the command of an execution and returns its standard output,
+// its standard error and its exit code.  An error is returned if the command
+// could not be run or did not complete successfully.  The command is interrupted
+// when the context is done.
+type CommandRunner func(ctx context.Context, execution configparser.ExecutionConfig) (stdout, stderr string, exitCode int, err error)
+
+// The type of the executions computing their value from other executions
+const expressionExecutionType = "expression"
+
+// The timestamps given by the commands cannot be later than this duration after
+// the current time, which allows for clocks which are not exactly synchronized
+const maxTimestampSkew = 24 * time.Hour
+
+// errScrapeCancelled is the error of the executions interrupted or skipped because
+// the scrape was cancelled, usually because its deadline expired
+var errScrapeCancelled = errors.New("Scrape cancelled")
+
+// ExecutionResult holds the details of a single execution of a command
+// during a collection
+type ExecutionResult struct {
+	Metric   string
+	Labels   map[string]string
+	Command  string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Duration time.Duration
+	Value    float64
+	// The time the value was measured, given by the output of the command,
+	// or zero for the time of the scrape
+	Timestamp time.Time
+	// Err is set if the execution did not produce a value for the metric
+	Err error
 }
 
 func getKeys(mymap map[string]string) []string {
@@ -32,78 +92,467 @@ func getKeys(mymap map[string]string) []string {
 //AddMetrics -
 func (m *MetricsCollector) AddMetrics(metrics []configparser.MetricsConfig) {
 	m.metricsConfig = metrics
-	m.gaugeVecs = make([]*prometheus.GaugeVec, len(metrics))
+	m.metricVecs = make([]metricVec, len(metrics))
 
+	m.expressionsByID = map[string]configparser.ExecutionConfig{}
+	m.dependencies = map[string][]string{}
+	metricOfID := map[string]string{}
 	for i, metric := range m.metricsConfig {
-		if metric.MetricType == "gauge" {
-			m.gaugeVecs[i] = prometheus.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Name: metric.Name,
-					Help: metric.Help,
-				},
-				getKeys(metric.Executions[0].Labels),
-			)
-		} else {
-			panic("Only the gauge metric is supported at the moment")
+		m.metricVecs[i] = newMetricVec(metric)
+
+		for _, execution := range metric.Executions {
+			if execution.ID != "" {
+				metricOfID[execution.ID] = metric.Name
+				if execution.ExecutionType == expressionExecutionType {
+					m.expressionsByID[execution.ID] = execution
+				}
+			}
 		}
 	}
-}
 
-func (m *MetricsCollector) getMetrics() {
-	for i, metric := range m.metricsConfig {
+	for _, metric := range m.metricsConfig {
 		for _, execution := range metric.Executions {
-			cmd := exec.Command(execution.ExecutionType, "-c", execution.Command)
-
-			var timedout bool
-			timeout := *execution.Timeout
-			if timeout != 0 {
-				timer := time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
-					timedout = true
-					cmd.Process.Kill()
-				})
-				defer timer.Stop()
+			if execution.ExecutionType != expressionExecutionType {
+				continue
 			}
-			output, err := cmd.Output()
-			if timedout {
-				log.Println("Timeout when running:", execution.Command)
+			// The expressions were verified when parsing the configuration
+			if parsed, err := expression.Parse(execution.Command); err == nil {
+				for _, id := range parsed.Variables() {
+					m.dependencies[metric.Name] = append(m.dependencies[metric.Name], metricOfID[id])
+				}
+			}
+		}
+	}
+}
+
+// neededMetrics returns the selected metrics along with the metrics whose executions
+// their expressions use, or nil if every metric is selected
+func (m *MetricsCollector) neededMetrics(selected map[string]bool) map[string]bool {
+	if selected == nil {
+		return nil
+	}
+
+	needed := map[string]bool{}
+	var add func(name string)
+	add = func(name string) {
+		if needed[name] {
+			return
+		}
+		needed[name] = true
+		for _, dependency := range m.dependencies[name] {
+			add(dependency)
+		}
+	}
+	for name := range selected {
+		add(name)
+	}
+	return needed
+}
+
+// SetMinInterval makes the scrapes happening within the given duration after
+// a collection reuse its results instead of running the executions again
+func (m *MetricsCollector) SetMinInterval(minInterval time.Duration) {
+	m.minInterval = minInterval
+}
+
+// SetCommandRunner replaces the way the commands of the executions are run,
+// which allows to test the exporter without running the actual commands
+func (m *MetricsCollector) SetCommandRunner(runner CommandRunner) {
+	m.runner = runner
+}
+
+// runShellCommand is the default CommandRunner, which runs the command
+// using the shell of the execution
+func runShellCommand(ctx context.Context, execution configparser.ExecutionConfig) (string, string, int, error) {
+	cmd := exec.Command(execution.ExecutionType, "-c", execution.Command)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := startCommand(cmd); err != nil {
+		return "", "", -1, fmt.Errorf("Got error when running: %s: %v", execution.Command, err)
+	}
+
+	var timedout, cancelled bool
+	var timedoutMutex sync.Mutex
+	timeout := *execution.Timeout
+	if timeout != 0 {
+		timer := time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			timedoutMutex.Lock()
+			timedout = true
+			timedoutMutex.Unlock()
+			killProcessGroup(cmd)
+		})
+		defer timer.Stop()
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		timedoutMutex.Lock()
+		cancelled = true
+		timedoutMutex.Unlock()
+		killProcessGroup(cmd)
+	})
+	defer stop()
+
+	err := finishCommand(cmd)
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+
+	timedoutMutex.Lock()
+	defer timedoutMutex.Unlock()
+	if timedout {
+		err = errors.New("Timeout when running: " + execution.Command)
+	} else if cancelled {
+		err = fmt.Errorf("%w when running: %s", errScrapeCancelled, execution.Command)
+	} else if err != nil {
+		err = fmt.Errorf("Got error when running: %s: %v", execution.Command, err)
+	}
+
+	return stdout.String(), stderr.String(), exitCode, err
+}
+
+// runCommand runs the command of an execution, without parsing its result
+func (m *MetricsCollector) runCommand(ctx context.Context, metricName string, execution configparser.ExecutionConfig) ExecutionResult {
+	result := ExecutionResult{
+		Metric:  metricName,
+		Labels:  execution.Labels,
+		Command: execution.Command,
+	}
+
+	runner := m.runner
+	if runner == nil {
+		runner = runShellCommand
+	}
+
+	// The remaining executions are skipped once the scrape is cancelled
+	if ctx.Err() != nil {
+		result.ExitCode = -1
+		result.Err = fmt.Errorf("%w before running: %s", errScrapeCancelled, execution.Command)
+		return result
+	}
+
+	start := time.Now()
+	stdout, stderr, exitCode, err := runner(ctx, execution)
+	result.Duration = time.Since(start)
+	result.Stdout = stdout
+	result.Stderr = stderr
+	result.ExitCode = exitCode
+	result.Err = err
+	return result
+}
+
+// runExecution runs the command of an execution and parses its result
+func (m *MetricsCollector) runExecution(ctx context.Context, metricName string, execution configparser.ExecutionConfig) ExecutionResult {
+	result := m.runCommand(ctx, metricName, execution)
+
+	// The value is parsed from the output without its timestamp
+	parsed := result
+	if execution.TimestampFrom == "output" && result.Err == nil {
+		var err error
+		if parsed.Stdout, result.Timestamp, err = splitTimestamp(result.Stdout); err != nil {
+			result.Err = fmt.Errorf("Got error when parsing timestamp of: %s. %v", execution.Command, err)
+			return result
+		}
+	}
+
+	value, err := resultValue(execution, parsed)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Err = nil
+	if execution.Transform != nil {
+		value = execution.Transform.Apply(value)
+	}
+	result.Value = value
+	return result
+}
+
+// resultValue returns the value of the metric given by the result of an execution
+func resultValue(execution configparser.ExecutionConfig, result ExecutionResult) (float64, error) {
+	// A command which completed with a non-zero exit code is not a failure when
+	// its exit code is the value, unlike one which was interrupted
+	if execution.ValueFrom == "exitCode" && result.ExitCode >= 0 && !errors.Is(result.Err, errScrapeCancelled) {
+		return float64(result.ExitCode), nil
+	}
+
+	if result.Err != nil {
+		return 0, result.Err
+	}
+
+	switch execution.ValueFrom {
+	case "duration":
+		return result.Duration.Seconds(), nil
+	case "outputLines":
+		return float64(countLines(result.Stdout)), nil
+	case "outputBytes":
+		return float64(len(result.Stdout)), nil
+	}
+
+	countStr := strings.TrimSpace(result.Stdout)
+	if value, ok := execution.ValueMap[countStr]; ok {
+		return value, nil
+	}
+	if execution.DefaultValue != nil {
+		return *execution.DefaultValue, nil
+	}
+
+	parse := func(output string) (float64, error) { return strconv.ParseFloat(output, 64) }
+	if execution.Transform != nil {
+		parse = execution.Transform.ParseOutput
+	}
+
+	count, err := parse(countStr)
+	if err != nil {
+		return 0, fmt.Errorf("Got error when parsing result of: %s. Expecting integer result but got %v and error %v",
+			execution.Command, countStr, err)
+	}
+	return count, nil
+}
+
+// splitTimestamp splits an output made of a value followed by the time it was measured,
+// as seconds since the epoch or in RFC 3339 format, e.g., "42 1700000000"
+func splitTimestamp(output string) (string, time.Time, error) {
+	output = strings.TrimSpace(output)
+	separator := strings.LastIndexAny(output, " \t\n")
+	if separator < 0 {
+		return "", time.Time{}, fmt.Errorf("Expecting a value followed by a timestamp but got %q", output)
+	}
+
+	value, timestamp := output[:separator], output[separator+1:]
+	var parsed time.Time
+	if seconds, err := strconv.ParseFloat(timestamp, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		parsed = time.Unix(int64(whole), int64(fraction*1e9))
+	} else if parsed, err = time.Parse(time.RFC3339Nano, timestamp); err != nil {
+		return "", time.Time{}, fmt.Errorf("Expecting seconds since the epoch or an RFC 3339 timestamp but got %q", timestamp)
+	}
+
+	// A timestamp in milliseconds, such as the ones of the exposition format, would
+	// be thousands of years in the future and the sample would be dropped
+	if parsed.After(time.Now().Add(maxTimestampSkew)) {
+		return "", time.Time{}, fmt.Errorf("Timestamp %q is in the future, expecting seconds since the epoch", timestamp)
+	}
+	return value, parsed, nil
+}
+
+// countLines returns the number of lines of an output, whose last line may
+// not end with a newline
+func countLines(output string) int {
+	lines := strings.Count(output, "\n")
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		lines++
+	}
+	return lines
+}
+
+// evaluateExpression computes the value of an execution of type expression from the
+// values of the executions, by id, evaluating the other expressions it uses if needed
+func (m *MetricsCollector) evaluateExpression(execution configparser.ExecutionConfig, values map[string]float64) (float64, error) {
+	parsed, err := expression.Parse(execution.Command)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := parsed.Evaluate(func(id string) (float64, error) {
+		if value, ok := values[id]; ok {
+			return value, nil
+		}
+		if other, ok := m.expressionsByID[id]; ok {
+			value, err := m.evaluateExpression(other, values)
+			if err == nil {
+				values[id] = value
+			}
+			return value, err
+		}
+		return 0, errors.New("No value for execution '" + id + "'")
+	})
+	if err == nil && execution.Transform != nil {
+		value = execution.Transform.Apply(value)
+	}
+	return value, err
+}
+
+// runExpression evaluates an execution of type expression once the commands have run
+func (m *MetricsCollector) runExpression(ctx context.Context, metricName string, execution configparser.ExecutionConfig,
+	values map[string]float64) ExecutionResult {
+	result := ExecutionResult{
+		Metric:  metricName,
+		Labels:  execution.Labels,
+		Command: execution.Command,
+	}
+
+	// The values of the executions which were skipped are missing
+	if ctx.Err() != nil {
+		result.Err = fmt.Errorf("%w before evaluating: %s", errScrapeCancelled, execution.Command)
+		return result
+	}
+
+	if value, ok := values[execution.ID]; ok && execution.ID != "" {
+		result.Value = value
+		return result
+	}
+
+	value, err := m.evaluateExpression(execution, values)
+	if err != nil {
+		result.Err = fmt.Errorf("Got error when evaluating: %s: %v", execution.Command, err)
+		return result
+	}
+	if execution.ID != "" {
+		values[execution.ID] = value
+	}
+	result.Value = value
+	return result
+}
+
+// getMetrics runs the executions of the selected metrics, or of every metric if
+// selected is nil, and sets the value of the metrics from their results.
+// The executions of type expression are evaluated once all the commands have run.
+func (m *MetricsCollector) getMetrics(ctx context.Context, selected map[string]bool) []ExecutionResult {
+	var results []ExecutionResult
+	needed := m.neededMetrics(selected)
+
+	// The values of the executions having an id, used by the expressions
+	values := map[string]float64{}
+	type pendingExpression struct {
+		metric    int
+		execution configparser.ExecutionConfig
+	}
+	var expressions []pendingExpression
+
+	for i, metric := range m.metricsConfig {
+		if needed != nil && !needed[metric.Name] {
+			continue
+		}
+
+		executions := metric.Executions
+		discovered := metric.Foreach != nil && metric.Foreach.Command != ""
+		if discovered {
+			var result ExecutionResult
+			executions, result = m.discoverExecutions(ctx, metric)
+			results = append(results, result)
+			if result.Err != nil {
+				logExecutionError(result)
 				continue
 			}
+		}
 
-			if err != nil {
-				log.Println("Got error when running:", execution.Command+":", err)
+		for _, execution := range executions {
+			if execution.ExecutionType == expressionExecutionType {
+				expressions = append(expressions, pendingExpression{i, execution})
 				continue
 			}
 
-			countStr := strings.TrimSpace(string(output))
-			count, err := strconv.ParseFloat(countStr, 64)
-			if err != nil {
-				log.Printf(
-					"Got error when parsing result of: "+execution.Command+
-						". Expecting integer result but got %v and error "+err.Error(), countStr)
+			result := m.runCached(ctx, metric.Name, execution, m.runWithRetries)
+			results = append(results, result)
+
+			if result.Err != nil {
+				logExecutionError(result)
 				continue
 			}
 
+			if execution.ID != "" {
+				values[execution.ID] = result.Value
+			}
 			// Now set the metrics
-			m.gaugeVecs[i].With(execution.Labels).Set(count)
+			m.metricVecs[i].set(execution.Labels, result.Value, result.Timestamp)
+		}
+
+		// Drop the series and the circuit breakers of the items which are no longer discovered
+		if discovered {
+			labels := make([]map[string]string, len(executions))
+			for j, execution := range executions {
+				labels[j] = execution.Labels
+			}
+			m.metricVecs[i].retain(labels)
+			m.retainBreakers(metric.Name, executions)
+		}
+	}
+
+	for _, pending := range expressions {
+		result := m.runExpression(ctx, m.metricsConfig[pending.metric].Name, pending.execution, values)
+		results = append(results, result)
+
+		if result.Err != nil {
+			logExecutionError(result)
+			continue
+		}
+		m.metricVecs[pending.metric].set(pending.execution.Labels, result.Value, result.Timestamp)
+	}
+
+	return results
+}
+
+// discoverExecutions runs the command giving the items of the 'foreach' of a metric,
+// and returns the executions of the metric generated for these items
+func (m *MetricsCollector) discoverExecutions(ctx context.Context, metric configparser.MetricsConfig) ([]configparser.ExecutionConfig, ExecutionResult) {
+	// The items are discovered again once the cache of the metric expires
+	discovery := metric.Foreach.DiscoveryExecution()
+	discovery.CacheTTL = metric.CacheTTL
+	discovery.StaleWhileRevalidate = metric.StaleWhileRevalidate
+	result := m.runCached(ctx, metric.Name, discovery, m.runCommand)
+	if result.Err != nil {
+		return nil, result
+	}
+
+	var items []string
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		item := strings.TrimSpace(line)
+		if item == "" {
+			continue
 		}
+		// The items are label values, which must be valid UTF-8
+		if !utf8.ValidString(item) || strings.ContainsRune(item, 0) {
+			log.Printf("Ignoring item %q discovered for metric %s, which is not valid UTF-8", item, metric.Name)
+			continue
+		}
+		items = append(items, item)
 	}
+
+	executions, err := metric.ForeachExecutions(items)
+	result.Err = err
+
+	// The labels of different items can still be the same, e.g., when they are truncated
+	var kept []configparser.ExecutionConfig
+	seen := map[string]bool{}
+	for _, execution := range executions {
+		labels := formatLabels(execution.Labels)
+		if seen[labels] {
+			log.Printf("Ignoring execution %q of metric %s, whose labels {%s} are the same as the ones of another discovered item",
+				execution.Command, metric.Name, labels)
+			continue
+		}
+		seen[labels] = true
+		kept = append(kept, execution)
+	}
+	return kept, result
+}
+
+func logExecutionError(result ExecutionResult) {
+	if !errors.Is(result.Err, errScrapeCancelled) && !errors.Is(result.Err, errCircuitOpen) {
+		log.Println(result.Err)
+	}
+}
+
+// LastResults returns the details of each execution of the last collection
+func (m *MetricsCollector) LastResults() []ExecutionResult {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.lastResults
 }
 
 // Describe - Implements Collector.Describe
 func (m *MetricsCollector) Describe(ch chan<- *prometheus.Desc) {
-	for _, m := range m.gaugeVecs {
+	for _, m := range m.metricVecs {
 		m.Describe(ch)
 	}
 }
 
 // Collect - Implements Collector.Collect
 func (m *MetricsCollector) Collect(ch chan<- prometheus.Metric) {
-	m.mutex.Lock() // To protect metrics from concurrent collects.
-	defer m.mutex.Unlock()
-
-	m.getMetrics()
-
-	for _, m := range m.gaugeVecs {
-		m.Collect(ch)
-	}
+	m.collect(context.Background(), ch, nil)
 }
@@ -0,0 +1,739 @@
+package metricscollector
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/assert"
+)
+
+func execution(command string, timeout uint) configparser.ExecutionConfig {
+	return configparser.ExecutionConfig{
+		ExecutionType: "sh",
+		Command:       command,
+		Timeout:       &timeout,
+	}
+}
+
+func TestRunShellCommand(t *testing.T) {
+	stdout, stderr, exitCode, err := runShellCommand(context.Background(), execution("echo 12; echo oops >&2", 1000))
+	assert.NilError(t, err)
+	assert.Equal(t, stdout, "12\n")
+	assert.Equal(t, stderr, "oops\n")
+	assert.Equal(t, exitCode, 0)
+}
+
+func TestRunShellCommandTimeoutKillsPipeline(t *testing.T) {
+	start := time.Now()
+	_, _, _, err := runShellCommand(context.Background(), execution("sleep 10 | cat", 100))
+	assert.ErrorContains(t, err, "Timeout when running: sleep 10 | cat")
+	assert.Assert(t, time.Since(start) < 5*time.Second, "The processes of the pipeline were not killed")
+}
+
+func TestTerminateCommands(t *testing.T) {
+	defer func() { terminating = false }()
+
+	done := make(chan error)
+	go func() {
+		_, _, _, err := runShellCommand(context.Background(), execution("sleep 10 | cat", 0))
+		done <- err
+	}()
+
+	// Wait for the command to start
+	for i := 0; i < 100; i++ {
+		processesMutex.Lock()
+		running := len(processes)
+		processesMutex.Unlock()
+		if running > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, TerminateCommands(), 1)
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "Got error when running: sleep 10 | cat")
+	case <-time.After(5 * time.Second):
+		t.Fatal("The command was not terminated")
+	}
+
+	// No new command can be run
+	_, _, _, err := runShellCommand(context.Background(), execution("echo 1", 0))
+	assert.Assert(t, strings.Contains(err.Error(), errTerminating.Error()), err.Error())
+}
+
+func TestCounterCreatedOnReset(t *testing.T) {
+	counter := newCounterVec("test_total", "Some total", []string{"state"})
+	now := time.Unix(1000, 0)
+	counter.now = func() time.Time { return now }
+
+	labels := map[string]string{"state": "running"}
+	counter.set(labels, 10, time.Time{})
+	now = time.Unix(2000, 0)
+	counter.set(labels, 15, time.Time{})
+	assert.Equal(t, counter.series["running"].created, time.Unix(1000, 0))
+
+	// A decreasing value is a reset of the counter
+	now = time.Unix(3000, 0)
+	counter.set(labels, 2, time.Time{})
+	assert.Equal(t, counter.series["running"].created, time.Unix(3000, 0))
+	assert.Equal(t, counter.series["running"].value, float64(2))
+}
+
+func TestCollectSkipsExecutionsOnceCancelled(t *testing.T) {
+	m := MetricsCollector{}
+	m.AddMetrics([]configparser.MetricsConfig{
+		{Name: "first_value", Help: "Some value", MetricType: "gauge", Executions: []configparser.ExecutionConfig{execution("echo 1", 0)}},
+		{Name: "second_value", Help: "Some value", MetricType: "gauge", Executions: []configparser.ExecutionConfig{execution("echo 2", 0)}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := 0
+	m.SetCommandRunner(func(runCtx context.Context, execution configparser.ExecutionConfig) (string, string, int, error) {
+		// The scrape is cancelled while running the first execution, which
+		// cancels the collection as no other scrape is waiting for it
+		ran++
+		cancel()
+		<-runCtx.Done()
+		return "1", "", 0, nil
+	})
+
+	ch := make(chan prometheus.Metric, 10)
+	assert.Assert(t, m.collect(ctx, ch, nil))
+	assert.Equal(t, ran, 1)
+	assert.NilError(t, m.LastResults()[0].Err)
+	assert.Assert(t, errors.Is(m.LastResults()[1].Err, errScrapeCancelled))
+}
+
+func countingCollector(release chan struct{}) (*MetricsCollector, *int32) {
+	var runs int32
+	m := &MetricsCollector{}
+	m.AddMetrics([]configparser.MetricsConfig{
+		{Name: "test_value", Help: "Some value", MetricType: "gauge", Executions: []configparser.ExecutionConfig{execution("echo 1", 0)}},
+	})
+	m.SetCommandRunner(func(_ context.Context, execution configparser.ExecutionConfig) (string, string, int, error) {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return "1", "", 0, nil
+	})
+	return m, &runs
+}
+
+func TestConcurrentScrapesShareCollection(t *testing.T) {
+	release := make(chan struct{})
+	m, runs := countingCollector(release)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch := make(chan prometheus.Metric, 10)
+			m.collect(context.Background(), ch, nil)
+			assert.Equal(t, len(ch), 1)
+		}()
+	}
+
+	// Let the scrapes start, then complete the collection
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, atomic.LoadInt32(runs), int32(1))
+
+	// Without a minimum interval, the next scrape runs the commands again
+	m.collect(context.Background(), make(chan prometheus.Metric, 10), nil)
+	assert.Equal(t, atomic.LoadInt32(runs), int32(2))
+}
+
+func TestCancelledScrapeDoesNotCancelSharedCollection(t *testing.T) {
+	release := make(chan struct{})
+	m, runs := countingCollector(release)
+
+	// The first scrape starts the collection, then gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan bool)
+	go func() {
+		first <- m.collect(ctx, make(chan prometheus.Metric, 10), nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	second := make(chan bool)
+	ch := make(chan prometheus.Metric, 10)
+	go func() {
+		second <- m.collect(context.Background(), ch, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	assert.Assert(t, <-first)
+
+	// The scrape which joined the collection still gets every value
+	close(release)
+	assert.Assert(t, !<-second)
+	assert.Equal(t, len(ch), 1)
+	assert.Equal(t, atomic.LoadInt32(runs), int32(1))
+	assert.NilError(t, m.LastResults()[0].Err)
+}
+
+func TestMinIntervalReusesCollection(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	m, runs := countingCollector(release)
+	m.SetMinInterval(time.Hour)
+
+	m.collect(context.Background(), make(chan prometheus.Metric, 10), nil)
+	m.collect(context.Background(), make(chan prometheus.Metric, 10), nil)
+	assert.Equal(t, atomic.LoadInt32(runs), int32(1))
+}
+
+func TestForeachDiscoversItems(t *testing.T) {
+	config := configparser.Config{MainListenAddress: ":9530"}
+	exporterCfg, err := config.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: service_active
+  help: Whether a service is active
+  type: gauge
+  foreach:
+    type: sh
+    command: list-services
+  executions:
+  - type: sh
+    command: is-active {{ .Item }}
+    labels:
+      service: '{{ .Item }}'
+`))
+	assert.NilError(t, err)
+
+	services := "cron\nssh\n"
+	m := MetricsCollector{}
+	m.AddMetrics(exporterCfg.Metrics)
+	m.SetCommandRunner(func(_ context.Context, execution configparser.ExecutionConfig) (string, string, int, error) {
+		if execution.Command == "list-services" {
+			return services, "", 0, nil
+		}
+		return "1", "", 0, nil
+	})
+
+	ch := make(chan prometheus.Metric, 10)
+	m.collect(context.Background(), ch, nil)
+	assert.Equal(t, len(ch), 2)
+	results := m.LastResults()
+	assert.Equal(t, len(results), 3)
+	assert.Equal(t, results[1].Command, "is-active 'cron'")
+	assert.DeepEqual(t, results[2].Labels, map[string]string{"service": "ssh"})
+
+	// The series of the items which are no longer discovered are dropped
+	services = "ssh\n"
+	ch = make(chan prometheus.Metric, 10)
+	m.collect(context.Background(), ch, nil)
+	assert.Equal(t, len(ch), 1)
+
+	// The items which are not valid label values are ignored
+	services = "ok\n\377\n"
+	ch = make(chan prometheus.Metric, 10)
+	m.collect(context.Background(), ch, nil)
+	assert.Equal(t, len(ch), 1)
+	results = m.LastResults()
+	assert.Equal(t, len(results), 2)
+	assert.DeepEqual(t, results[1].Labels, map[string]string{"service": "ok"})
+
+	// The discovered items are substituted as a single argument
+	services = "a b; reboot\n"
+	m.collect(context.Background(), make(chan prometheus.Metric, 10), nil)
+	assert.Equal(t, m.LastResults()[1].Command, `is-active 'a b; reboot'`)
+}
+
+func TestForeachDuplicateLabels(t *testing.T) {
+	config := configparser.Config{MainListenAddress: ":9530"}
+	exporterCfg, err := config.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: service_active
+  help: Whether a service is active
+  type: gauge
+  foreach:
+    command: list-services
+  executions:
+  - type: sh
+    command: is-active {{ .Item }}
+    labels:
+      service: '{{ .Item | lower }}'
+`))
+	assert.NilError(t, err)
+
+	m := MetricsCollector{}
+	m.AddMetrics(exporterCfg.Metrics)
+	m.SetCommandRunner(func(_ context.Context, execution configparser.ExecutionConfig) (string, string, int, error) {
+		if execution.Command == "list-services" {
+			return "cron\nCRON\n", "", 0, nil
+		}
+		return "1", "", 0, nil
+	})
+
+	// The items whose labels are the same as the ones of a previous item are ignored
+	ch := make(chan prometheus.Metric, 10)
+	m.collect(context.Background(), ch, nil)
+	assert.Equal(t, len(ch), 1)
+	results := m.LastResults()
+	assert.Equal(t, len(results), 2)
+	assert.Equal(t, results[1].Command, "is-active 'cron'")
+}
+
+func TestValueMap(t *testing.T) {
+	m := MetricsCollector{}
+	failed := float64(-1)
+	mapped := execution("systemctl is-active cron", 0)
+	mapped.ValueMap = map[string]float64{"active": 1, "inactive": 0}
+
+	for _, test := range []struct {
+		stdout       string
+		defaultValue *float64
+		value        float64
+		valid        bool
+	}{
+		{"active\n", nil, 1, true},
+		{" inactive ", nil, 0, true},
+		{"42", nil, 42, true},
+		{"activating", nil, 0, false},
+		{"activating", &failed, -1, true},
+	} {
+		stdout := test.stdout
+		m.SetCommandRunner(func(_ context.Context, _ configparser.ExecutionConfig) (string, string, int, error) {
+			return stdout, "", 0, nil
+		})
+		mapped.DefaultValue = test.defaultValue
+
+		result := m.runExecution(context.Background(), "test_value", mapped)
+		assert.Equal(t, result.Err == nil, test.valid, "Output: "+test.stdout)
+		assert.Equal(t, result.Value, test.value, "Output: "+test.stdout)
+	}
+}
+
+func TestValueFrom(t *testing.T) {
+	m := MetricsCollector{}
+	for _, test := range []struct {
+		valueFrom string
+		command   string
+		value     float64
+	}{
+		{"exitCode", "exit 3", 3},
+		{"exitCode", "true", 0},
+		{"outputLines", "printf 'a\\nb\\nc'", 3},
+		{"outputLines", "printf 'a\\nb\\n'", 2},
+		{"outputLines", "true", 0},
+		{"outputBytes", "printf abcd", 4},
+	} {
+		exec := execution(test.command, 1000)
+		exec.ValueFrom = test.valueFrom
+		result := m.runExecution(context.Background(), "test_value", exec)
+		assert.NilError(t, result.Err, test.command)
+		assert.Equal(t, result.Value, test.value, test.command)
+	}
+
+	exec := execution("sleep 0.1", 1000)
+	exec.ValueFrom = "duration"
+	result := m.runExecution(context.Background(), "test_value", exec)
+	assert.NilError(t, result.Err)
+	assert.Assert(t, result.Value >= 0.1, result.Value)
+
+	// Only the exit code of a command which completed is a value
+	exec = execution("sleep 10", 100)
+	exec.ValueFrom = "exitCode"
+	assert.ErrorContains(t, m.runExecution(context.Background(), "test_value", exec).Err, "Timeout when running")
+
+	exec = execution("exit 3", 1000)
+	exec.ValueFrom = "outputLines"
+	assert.ErrorContains(t, m.runExecution(context.Background(), "test_value", exec).Err, "exit status 3")
+}
+
+func TestTimestampFrom(t *testing.T) {
+	m := MetricsCollector{}
+	measured := execution("cat /var/lib/batch/result", 0)
+	measured.TimestampFrom = "output"
+	measured.ValueMap = map[string]float64{"ok": 1}
+
+	for _, test := range []struct {
+		stdout    string
+		value     float64
+		timestamp time.Time
+		valid     bool
+	}{
+		{"42 1700000000\n", 42, time.Unix(1700000000, 0), true},
+		{"0.5\t1700000000.25", 0.5, time.Unix(1700000000, 250000000), true},
+		{"ok 2024-03-01T12:00:00Z", 1, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), true},
+		{"42", 0, time.Time{}, false},
+		{"42 yesterday", 0, time.Time{}, false},
+		{"42 1700000000000", 0, time.Time{}, false},
+		{"42 " + time.Now().Add(48*time.Hour).Format(time.RFC3339), 0, time.Time{}, false},
+	} {
+		stdout := test.stdout
+		m.SetCommandRunner(func(_ context.Context, _ configparser.ExecutionConfig) (string, string, int, error) {
+			return stdout, "", 0, nil
+		})
+
+		result := m.runExecution(context.Background(), "test_value", measured)
+		assert.Equal(t, result.Err == nil, test.valid, "Output: "+test.stdout)
+		assert.Equal(t, result.Value, test.value, "Output: "+test.stdout)
+		assert.Assert(t, result.Timestamp.Equal(test.timestamp), "Output: "+test.stdout)
+	}
+
+	// The samples have the timestamp of the output, but not the ones of other series
+	gauge := newMetricVec(configparser.MetricsConfig{
+		Name:       "test_value",
+		Help:       "Some value",
+		MetricType: "gauge",
+		Executions: []configparser.ExecutionConfig{{Labels: map[string]string{"job": "batch"}}},
+	})
+	gauge.set(map[string]string{"job": "batch"}, 42, time.Unix(1700000000, 0))
+	gauge.set(map[string]string{"job": "live"}, 1, time.Time{})
+
+	ch := make(chan prometheus.Metric, 10)
+	gauge.Collect(ch)
+	close(ch)
+	timestamps := map[string]int64{}
+	for metric := range ch {
+		var sample dto.Metric
+		assert.NilError(t, metric.Write(&sample))
+		timestamps[sample.GetLabel()[0].GetValue()] = sample.GetTimestampMs()
+	}
+	assert.DeepEqual(t, timestamps, map[string]int64{"batch": 1700000000000, "live": 0})
+}
+
+func TestCacheTTL(t *testing.T) {
+	var runs int32
+	m := MetricsCollector{}
+	m.SetCommandRunner(func(_ context.Context, execution configparser.ExecutionConfig) (string, string, int, error) {
+		atomic.AddInt32(&runs, 1)
+		if execution.Command == "false" {
+			return "", "", 1, errors.New("exit status 1")
+		}
+		return "42", "", 0, nil
+	})
+
+	ttl := uint(100)
+	cached := execution("docker images -q | wc -l", 0)
+	cached.CacheTTL = &ttl
+	failing := execution("false", 0)
+	failing.CacheTTL = &ttl
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, m.runCached(context.Background(), "test_images", cached, m.runExecution).Value, float64(42))
+		assert.ErrorContains(t, m.runCached(context.Background(), "test_images", failing, m.runExecution).Err, "exit status 1")
+	}
+	// The failures are not cached
+	assert.Equal(t, atomic.LoadInt32(&runs), int32(4))
+
+	time.Sleep(150 * time.Millisecond)
+	m.runCached(context.Background(), "test_images", cached, m.runExecution)
+	assert.Equal(t, atomic.LoadInt32(&runs), int32(5))
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	value := int32(1)
+	m := MetricsCollector{}
+	m.SetCommandRunner(func(_ context.Context, _ configparser.ExecutionConfig) (string, string, int, error) {
+		return strconv.Itoa(int(atomic.LoadInt32(&value))), "", 0, nil
+	})
+
+	ttl := uint(50)
+	stale := true
+	cached := execution("dpkg -l | grep -c ^ii", 0)
+	cached.CacheTTL = &ttl
+	cached.StaleWhileRevalidate = &stale
+
+	assert.Equal(t, m.runCached(context.Background(), "test_packages", cached, m.runExecution).Value, float64(1))
+
+	// The expired value is served while the execution runs again in the background
+	atomic.StoreInt32(&value, 2)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, m.runCached(context.Background(), "test_packages", cached, m.runExecution).Value, float64(1))
+
+	// The refreshed value is cached once the execution completed
+	deadline := time.Now().Add(time.Second)
+	for m.runCached(context.Background(), "test_packages", cached, m.runExecution).Value != 2 {
+		assert.Assert(t, time.Now().Before(deadline), "The value was not refreshed")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The expired value is still served when the scrapes are further apart than twice
+	// the TTL, even though caching another result drops the old ones in between
+	atomic.StoreInt32(&value, 3)
+	time.Sleep(150 * time.Millisecond)
+	other := execution("apt list --upgradable | wc -l", 0)
+	other.CacheTTL = &ttl
+	m.runCached(context.Background(), "test_upgradable", other, m.runExecution)
+	assert.Equal(t, m.runCached(context.Background(), "test_packages", cached, m.runExecution).Value, float64(2))
+
+	// It is only dropped once it has not been used for a while
+	deadline = time.Now().Add(time.Second)
+	for m.runCached(context.Background(), "test_packages", cached, m.runExecution).Value != 3 {
+		assert.Assert(t, time.Now().Before(deadline), "The value was not refreshed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	key := executionKey("test_packages", cached)
+	m.cacheMutex.Lock()
+	m.cache[key].used = time.Now().Add(-staleCacheRetention - time.Second)
+	m.cacheMutex.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	m.runCached(context.Background(), "test_upgradable", other, m.runExecution)
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	assert.Assert(t, m.cache[key] == nil)
+}
+
+func TestRetries(t *testing.T) {
+	var runs int32
+	m := MetricsCollector{}
+	m.SetCommandRunner(func(_ context.Context, _ configparser.ExecutionConfig) (string, string, int, error) {
+		if atomic.AddInt32(&runs, 1) < 3 {
+			return "", "Cannot connect to the Docker daemon", 1, errors.New("exit status 1")
+		}
+		return "5", "", 0, nil
+	})
+
+	retried := execution("docker ps -q | wc -l", 0)
+	retried.Retries = 2
+	retried.RetryDelay = 10
+	start := time.Now()
+	result := m.runWithRetries(context.Background(), "test_containers", retried)
+	assert.NilError(t, result.Err)
+	assert.Equal(t, result.Value, float64(5))
+	assert.Equal(t, atomic.LoadInt32(&runs), int32(3))
+	// The delay is doubled for the second retry
+	assert.Assert(t, time.Since(start) >= 30*time.Millisecond)
+
+	atomic.StoreInt32(&runs, 0)
+	retried.Retries = 1
+	assert.ErrorContains(t, m.runWithRetries(context.Background(), "test_containers", retried).Err, "exit status 1")
+	assert.Equal(t, atomic.LoadInt32(&runs), int32(2))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var runs int32
+	daemonUp := false
+	m := MetricsCollector{}
+	m.SetCommandRunner(func(_ context.Context, _ configparser.ExecutionConfig) (string, string, int, error) {
+		atomic.AddInt32(&runs, 1)
+		if !daemonUp {
+			return "", "", -1, errors.New("Timeout when running: docker ps -q | wc -l")
+		}
+		return "5", "", 0, nil
+	})
+
+	broken := execution("docker ps -q | wc -l", 0)
+	broken.Labels = map[string]string{"state": "running"}
+	broken.CircuitBreaker = &configparser.CircuitBreakerConfig{Failures: 2, OpenDuration: 100}
+	breakerOpen := func() float64 {
+		ch := make(chan prometheus.Metric, 10)
+		m.collectBreakers(ch, nil)
+		close(ch)
+		var sample dto.Metric
+		assert.NilError(t, (<-ch).Write(&sample))
+		assert.Equal(t, sample.GetLabel()[0].GetValue(), `state="running"`)
+		assert.Equal(t, sample.GetLabel()[1].GetValue(), "test_containers")
+		return sample.GetGauge().GetValue()
+	}
+
+	m.runWithRetries(context.Background(), "test_containers", broken)
+	assert.Equal(t, breakerOpen(), float64(0))
+	m.runWithRetries(context.Background(), "test_containers", broken)
+	assert.Equal(t, breakerOpen(), float64(1))
+
+	// The execution is skipped while the circuit is open
+	result := m.runWithRetries(context.Background(), "test_containers", broken)
+	assert.Assert(t, errors.Is(result.Err, errCircuitOpen))
+	assert.Equal(t, atomic.LoadInt32(&runs), int32(2))
+
+	// Once the circuit was open, a single failure opens it again
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, breakerOpen(), float64(0))
+	m.runWithRetries(context.Background(), "test_containers", broken)
+	assert.Equal(t, breakerOpen(), float64(1))
+
+	time.Sleep(150 * time.Millisecond)
+	daemonUp = true
+	assert.NilError(t, m.runWithRetries(context.Background(), "test_containers", broken).Err)
+	m.runWithRetries(context.Background(), "test_containers", broken)
+	daemonUp = false
+	m.runWithRetries(context.Background(), "test_containers", broken)
+	assert.Equal(t, breakerOpen(), float64(0))
+}
+
+func TestCollectInvalidLabelValue(t *testing.T) {
+	for _, metricType := range []string{"gauge", "counter"} {
+		vec := newMetricVec(configparser.MetricsConfig{
+			Name:       "test_value",
+			Help:       "Some value",
+			MetricType: metricType,
+			Executions: []configparser.ExecutionConfig{{Labels: map[string]string{"item": "ok"}}},
+		})
+		vec.set(map[string]string{"item": "ok"}, 1, time.Time{})
+		vec.set(map[string]string{"item": "\xff"}, 2, time.Time{})
+
+		// The invalid series fails the scrape instead of crashing the exporter
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(vec)
+		_, err := registry.Gather()
+		assert.ErrorContains(t, err, "not valid UTF-8", metricType)
+	}
+}
+
+func TestCircuitBreakersOfDiscoveredItems(t *testing.T) {
+	config := configparser.Config{MainListenAddress: ":9530"}
+	exporterCfg, err := config.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: container_up
+  help: Whether a container is up
+  type: gauge
+  foreach:
+    type: sh
+    command: list-containers
+  executions:
+  - type: sh
+    command: inspect {{ .Item }}
+    circuitBreaker: {failures: 1, openDuration: 60000}
+    labels:
+      container: '{{ .Item }}'
+`))
+	assert.NilError(t, err)
+
+	containers := "web\ndb\n"
+	m := MetricsCollector{}
+	m.AddMetrics(exporterCfg.Metrics)
+	m.SetCommandRunner(func(_ context.Context, execution configparser.ExecutionConfig) (string, string, int, error) {
+		if execution.Command == "list-containers" {
+			return containers, "", 0, nil
+		}
+		return "", "", 1, errors.New("exit status 1")
+	})
+	breakers := func() []string {
+		ch := make(chan prometheus.Metric, 10)
+		m.collectBreakers(ch, nil)
+		close(ch)
+		var labels []string
+		for metric := range ch {
+			var sample dto.Metric
+			assert.NilError(t, metric.Write(&sample))
+			labels = append(labels, sample.GetLabel()[0].GetValue())
+		}
+		sort.Strings(labels)
+		return labels
+	}
+
+	m.collect(context.Background(), make(chan prometheus.Metric, 10), nil)
+	assert.DeepEqual(t, breakers(), []string{`container="db"`, `container="web"`})
+
+	// The circuit breakers of the items which are no longer discovered are dropped
+	containers = "web\n"
+	m.collect(context.Background(), make(chan prometheus.Metric, 10), nil)
+	assert.DeepEqual(t, breakers(), []string{`container="web"`})
+	assert.Equal(t, len(m.breakers), 1)
+}
+
+func TestExpressions(t *testing.T) {
+	config := configparser.Config{MainListenAddress: ":9530"}
+	exporterCfg, err := config.ParseExporter([]byte(`
+name: test-exporter
+metrics:
+- name: disk_bytes
+  help: Some disk usage
+  type: gauge
+  executions:
+  - type: expression
+    command: total - used
+    labels:
+      type: free
+  - type: sh
+    id: used
+    command: used
+    labels:
+      type: used
+- name: disk_total_bytes
+  help: Some disk size
+  type: gauge
+  executions:
+  - type: sh
+    id: total
+    command: total
+- name: disk_free_ratio
+  help: Some ratio
+  type: gauge
+  executions:
+  - type: expression
+    command: (total - used) / total
+`))
+	assert.NilError(t, err)
+
+	m := MetricsCollector{}
+	m.AddMetrics(exporterCfg.Metrics)
+	values := map[string]string{"used": "30", "total": "120"}
+	m.SetCommandRunner(func(_ context.Context, execution configparser.ExecutionConfig) (string, string, int, error) {
+		value, ok := values[execution.Command]
+		if !ok {
+			return "", "", 1, errors.New("Got error when running: " + execution.Command)
+		}
+		return value, "", 0, nil
+	})
+
+	valueOf := func(metricName string, labels ...string) float64 {
+		for _, result := range m.LastResults() {
+			if result.Metric == metricName && (len(labels) == 0 || result.Labels["type"] == labels[0]) {
+				assert.NilError(t, result.Err)
+				return result.Value
+			}
+		}
+		t.Fatal("No result for " + metricName)
+		return 0
+	}
+
+	m.collect(context.Background(), make(chan prometheus.Metric, 10), nil)
+	assert.Equal(t, valueOf("disk_bytes", "free"), float64(90))
+	assert.Equal(t, valueOf("disk_free_ratio"), 0.75)
+
+	// The executions used by the expressions of the selected metrics are run
+	// even if their metrics are not selected
+	ch := make(chan prometheus.Metric, 10)
+	m.collect(context.Background(), ch, []string{"disk_free_ratio"})
+	assert.Equal(t, len(ch), 1)
+	assert.Equal(t, valueOf("disk_free_ratio"), 0.75)
+
+	// The expressions using an execution which failed fail
+	delete(values, "total")
+	m.collect(context.Background(), make(chan prometheus.Metric, 10), nil)
+	for _, result := range m.LastResults() {
+		if result.Metric == "disk_free_ratio" {
+			assert.ErrorContains(t, result.Err, "No value for execution 'total'")
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	m := MetricsCollector{}
+	m.SetCommandRunner(func(_ context.Context, _ configparser.ExecutionConfig) (string, string, int, error) {
+		return "1.5G\n", "", 0, nil
+	})
+
+	transformed := execution("du -sh /var | cut -f1", 0)
+	decimals := uint(0)
+	transformed.Transform = &configparser.TransformConfig{Parse: "size", FromUnit: "B", Round: &decimals}
+	result := m.runExecution(context.Background(), "test_bytes", transformed)
+	assert.NilError(t, result.Err)
+	assert.Equal(t, result.Value, float64(1610612736))
+
+	// Without parsing the size, the output is not a number
+	transformed.Transform.Parse = ""
+	assert.ErrorContains(t, m.runExecution(context.Background(), "test_bytes", transformed).Err, "Got error when parsing result")
+}
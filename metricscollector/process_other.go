@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package metricscollector
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing as process groups are not supported
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills the command itself as process groups are not supported
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
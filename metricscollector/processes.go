@@ -0,0 +1,61 @@
+package metricscollector
+
+import (
+	"errors"
+	"os/exec"
+	"sync"
+)
+
+// errTerminating is returned when a command is not run because
+// the running commands are being terminated
+var errTerminating = errors.New("Commands are being terminated")
+
+// The commands currently running, across all collectors, so that they
+// can be terminated when the custom-prometheus-exporter shuts down
+var (
+	processesMutex sync.Mutex
+	processes      = map[*exec.Cmd]bool{}
+	terminating    bool
+)
+
+// startCommand starts a command and keeps track of it until finishCommand is called
+func startCommand(cmd *exec.Cmd) error {
+	processesMutex.Lock()
+	defer processesMutex.Unlock()
+
+	if terminating {
+		return errTerminating
+	}
+
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	processes[cmd] = true
+	return nil
+}
+
+// finishCommand waits for a command started with startCommand to complete
+func finishCommand(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+
+	processesMutex.Lock()
+	delete(processes, cmd)
+	processesMutex.Unlock()
+
+	return err
+}
+
+// TerminateCommands kills every command still running, along with the processes
+// they started, and prevents any new command from being run.  It returns the
+// number of commands which were killed.
+func TerminateCommands() int {
+	processesMutex.Lock()
+	defer processesMutex.Unlock()
+
+	terminating = true
+	for cmd := range processes {
+		killProcessGroup(cmd)
+	}
+	return len(processes)
+}
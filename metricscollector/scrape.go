@@ -0,0 +1,47 @@
+package metricscollector
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var scrapeTruncatedDesc = prometheus.NewDesc(
+	"custom_exporter_scrape_truncated",
+	"Whether the scrape was cancelled, usually because its deadline expired, before all the executions completed",
+	nil, nil,
+)
+
+// scrapeCollector collects the metrics of a single scrape
+type scrapeCollector struct {
+	ctx         context.Context
+	collector   *MetricsCollector
+	metricNames []string
+}
+
+// ScrapeCollector returns a collector for a single scrape, whose executions are
+// interrupted or skipped once the context is done.  The metrics of the executions
+// which completed are still produced, along with the custom_exporter_scrape_truncated
+// metric telling whether the scrape was cancelled, and the custom_exporter_circuit_breaker_open
+// metric telling which executions are skipped.  If metric names are given, only
+// the executions of these metrics are run.
+func (m *MetricsCollector) ScrapeCollector(ctx context.Context, metricNames []string) prometheus.Collector {
+	return &scrapeCollector{ctx: ctx, collector: m, metricNames: metricNames}
+}
+
+// Describe - Implements Collector.Describe
+func (s *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	s.collector.Describe(ch)
+	ch <- scrapeTruncatedDesc
+	ch <- circuitBreakerOpenDesc
+}
+
+// Collect - Implements Collector.Collect
+func (s *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	truncated := 0.0
+	if s.collector.collect(s.ctx, ch, s.metricNames) {
+		truncated = 1
+	}
+	ch <- prometheus.MustNewConstMetric(scrapeTruncatedDesc, prometheus.GaugeValue, truncated)
+	s.collector.collectBreakers(ch, s.metricNames)
+}
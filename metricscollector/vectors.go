@@ -0,0 +1,193 @@
+package metricscollector
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricVec holds the series of a metric, whose values are set from the
+// results of the executions
+type metricVec interface {
+	prometheus.Collector
+	// set sets the value of a series, measured at the given time, or at
+	// the time of the scrape if it is zero
+	set(labels map[string]string, value float64, timestamp time.Time)
+	// retain removes the series whose labels are not among the given ones
+	retain(labels []map[string]string)
+}
+
+// newMetricVec creates the series of a metric according to its type
+func newMetricVec(metric configparser.MetricsConfig) metricVec {
+	labelNames := getKeys(metric.Executions[0].Labels)
+
+	switch metric.MetricType {
+	case "gauge":
+		return &gaugeVec{newSeriesSet(metric.Name, metric.Help, labelNames)}
+	case "counter":
+		return newCounterVec(metric.Name, metric.Help, labelNames)
+	default:
+		panic("Unsupported metric type: " + metric.MetricType)
+	}
+}
+
+// seriesKey identifies the series of a metric having the given labels
+func seriesKey(labelNames []string, labels map[string]string) string {
+	labelValues := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		labelValues[i] = labels[name]
+	}
+	// Label values are valid UTF-8, which cannot contain this byte
+	return strings.Join(labelValues, "\xff")
+}
+
+// series is a single series of a metric
+type series struct {
+	labelValues []string
+	value       float64
+	// The time the value was measured, or zero for the time of the scrape
+	timestamp time.Time
+	// The creation time of the series of a counter
+	created time.Time
+}
+
+// seriesSet holds the series of a metric, by key of their labels
+type seriesSet struct {
+	mutex      sync.Mutex
+	desc       *prometheus.Desc
+	labelNames []string
+	series     map[string]*series
+}
+
+func newSeriesSet(name string, help string, labelNames []string) seriesSet {
+	return seriesSet{
+		desc:       prometheus.NewDesc(name, help, labelNames, nil),
+		labelNames: labelNames,
+		series:     map[string]*series{},
+	}
+}
+
+// get returns the series having the given labels, creating it if needed.  It
+// returns false if the series is new.  The mutex must be held.
+func (s *seriesSet) get(labels map[string]string) (*series, bool) {
+	key := seriesKey(s.labelNames, labels)
+	if found, ok := s.series[key]; ok {
+		return found, true
+	}
+
+	labelValues := make([]string, len(s.labelNames))
+	for i, name := range s.labelNames {
+		labelValues[i] = labels[name]
+	}
+	created := &series{labelValues: labelValues}
+	s.series[key] = created
+	return created, false
+}
+
+func (s *seriesSet) retain(labels []map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	kept := map[string]bool{}
+	for _, l := range labels {
+		kept[seriesKey(s.labelNames, l)] = true
+	}
+	for key := range s.series {
+		if !kept[key] {
+			delete(s.series, key)
+		}
+	}
+}
+
+// Describe - Implements Collector.Describe
+func (s *seriesSet) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+// withTimestamp gives its explicit timestamp to a sample whose value was measured
+// by the command, instead of letting the scraper use the time of the scrape
+func withTimestamp(metric prometheus.Metric, timestamp time.Time) prometheus.Metric {
+	if timestamp.IsZero() {
+		return metric
+	}
+	return prometheus.NewMetricWithTimestamp(timestamp, metric)
+}
+
+// gaugeVec holds the series of a gauge
+type gaugeVec struct {
+	seriesSet
+}
+
+func (g *gaugeVec) set(labels map[string]string, value float64, timestamp time.Time) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	series, _ := g.get(labels)
+	series.value = value
+	series.timestamp = timestamp
+}
+
+// Collect - Implements Collector.Collect
+func (g *gaugeVec) Collect(ch chan<- prometheus.Metric) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, series := range g.series {
+		metric, err := prometheus.NewConstMetric(g.desc, prometheus.GaugeValue, series.value, series.labelValues...)
+		// A series which cannot be produced, e.g., because a label value is not
+		// valid UTF-8, fails the scrape instead of crashing the exporter
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(g.desc, err)
+			continue
+		}
+		ch <- withTimestamp(metric, series.timestamp)
+	}
+}
+
+// counterVec holds the series of a counter.  The commands report the total
+// themselves, so the value of a series is set instead of being incremented.
+// The creation time of a series is the time it was first collected, or the
+// time its value was last seen decreasing, which is a reset of the counter.
+type counterVec struct {
+	seriesSet
+	// Returns the current time, which can be replaced by the tests
+	now func() time.Time
+}
+
+func newCounterVec(name string, help string, labelNames []string) *counterVec {
+	return &counterVec{
+		seriesSet: newSeriesSet(name, help, labelNames),
+		now:       time.Now,
+	}
+}
+
+func (c *counterVec) set(labels map[string]string, value float64, timestamp time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	series, found := c.get(labels)
+	if !found || value < series.value {
+		series.created = c.now()
+	}
+	series.value = value
+	series.timestamp = timestamp
+}
+
+// Collect - Implements Collector.Collect
+func (c *counterVec) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, series := range c.series {
+		metric, err := prometheus.NewConstMetricWithCreatedTimestamp(c.desc, prometheus.CounterValue,
+			series.value, series.created, series.labelValues...)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.desc, err)
+			continue
+		}
+		ch <- withTimestamp(metric, series.timestamp)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+)
+
+// runSchemaCommand prints the JSON Schema of the configuration files
+func runSchemaCommand() {
+	schema, err := configparser.Schema()
+	if err != nil {
+		log.Fatal("Error generating the configuration schema: ", err)
+	}
+	os.Stdout.Write(schema)
+}
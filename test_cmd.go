@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+	"github.com/marckhouzam/custom-prometheus-exporter/metricscollector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+// formatLabels returns the labels in the format used by the Prometheus exposition format
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// commentLines prefixes every line of a multi-line text so that it is
+// a comment in the Prometheus exposition format
+func commentLines(text string) string {
+	text = strings.TrimRight(text, "\n")
+	return strings.ReplaceAll(text, "\n", "\n#     ")
+}
+
+// printExecutionResult prints the diagnostics of an execution as comments so that
+// the output remains valid in the Prometheus exposition format
+func printExecutionResult(out io.Writer, result metricscollector.ExecutionResult) {
+	fmt.Fprintf(out, "# %s%s: exit code %d in %v\n",
+		result.Metric, formatLabels(result.Labels), result.ExitCode, result.Duration)
+	fmt.Fprintf(out, "#   command: %s\n", commentLines(result.Command))
+	if result.Stderr != "" {
+		fmt.Fprintf(out, "#   stderr: %s\n", commentLines(result.Stderr))
+	}
+	if result.Err != nil {
+		fmt.Fprintf(out, "#   error: %s\n", commentLines(result.Err.Error()))
+	}
+}
+
+// testExporter runs every execution of an exporter once and prints
+// the resulting metrics.  It returns false if any execution failed.
+func testExporter(out io.Writer, exporterCfg configparser.ExporterConfig) bool {
+	if exporterCfg.Probe != nil {
+		fmt.Fprintf(out, "# Exporter %s is a probe, which needs a target given by a test file\n\n", exporterCfg.Name)
+		return true
+	}
+
+	metricsCollector := metricscollector.MetricsCollector{}
+	metricsCollector.AddMetrics(exporterCfg.Metrics)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&metricsCollector)
+
+	fmt.Fprintf(out, "# Exporter %s on address %s and endpoint %s\n", exporterCfg.Name, exporterCfg.ListenAddress, exporterCfg.Endpoint)
+
+	families, err := registry.Gather()
+	success := err == nil
+	if err != nil {
+		fmt.Fprintf(out, "# error: %s\n", commentLines(err.Error()))
+	}
+
+	for _, result := range metricsCollector.LastResults() {
+		printExecutionResult(out, result)
+		if result.Err != nil {
+			success = false
+		}
+	}
+
+	for _, family := range families {
+		expfmt.MetricFamilyToText(out, family)
+	}
+	fmt.Fprintln(out)
+
+	return success
+}
+
+// stubRunner returns a CommandRunner which provides the result of the stubs
+// instead of running the commands
+func stubRunner(stubs []configparser.CommandStub) metricscollector.CommandRunner {
+	return func(_ context.Context, execution configparser.ExecutionConfig) (string, string, int, error) {
+		for _, stub := range stubs {
+			if stub.Command != execution.Command {
+				continue
+			}
+
+			var err error
+			if stub.ExitCode != 0 {
+				err = fmt.Errorf("Got error when running: %s: exit status %d", execution.Command, stub.ExitCode)
+			}
+			return stub.Stdout, stub.Stderr, stub.ExitCode, err
+		}
+		return "", "", -1, errors.New("No stub for command: " + execution.Command)
+	}
+}
+
+// runExporterTest verifies that the metrics produced by an exporter using
+// the stubs of a test are the expected ones.  It returns false if they differ.
+func runExporterTest(out io.Writer, exporterCfg configparser.ExporterConfig, test configparser.ExporterTest) bool {
+	metrics := exporterCfg.Metrics
+	if exporterCfg.Probe != nil {
+		var err error
+		if metrics, err = exporterCfg.ProbeMetrics(test.Target, test.Params); err != nil {
+			fmt.Fprintf(out, "--- FAIL: %s/%s: %v\n", exporterCfg.Name, test.Name, err)
+			return false
+		}
+	}
+
+	metricsCollector := metricscollector.MetricsCollector{}
+	metricsCollector.AddMetrics(metrics)
+	metricsCollector.SetCommandRunner(stubRunner(test.Stubs))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&metricsCollector)
+
+	var metricNames []string
+	if len(test.Metrics) > 0 {
+		metricNames = test.Metrics
+	}
+
+	err := testutil.GatherAndCompare(registry, strings.NewReader(test.Expected), metricNames...)
+	if err == nil {
+		fmt.Fprintf(out, "--- PASS: %s/%s\n", exporterCfg.Name, test.Name)
+		return true
+	}
+
+	fmt.Fprintf(out, "--- FAIL: %s/%s\n", exporterCfg.Name, test.Name)
+	fmt.Fprintln(out, strings.TrimSpace(err.Error()))
+	fmt.Fprintln(out)
+	for _, result := range metricsCollector.LastResults() {
+		printExecutionResult(out, result)
+	}
+	fmt.Fprintln(out)
+	return false
+}
+
+// runTestsFile runs the tests defined in a file against the exporter they target.
+// It returns false if any test failed.
+func runTestsFile(out io.Writer, config configparser.Config, file string) bool {
+	tests, err := configparser.ParseTestsFile(file)
+	if err != nil {
+		fmt.Fprintf(out, "--- FAIL: %s: %v\n", file, err)
+		return false
+	}
+
+	for _, exporterCfg := range config.Exporters {
+		if exporterCfg.Name != tests.Exporter {
+			continue
+		}
+
+		success := true
+		for _, test := range tests.Tests {
+			if !runExporterTest(out, exporterCfg, test) {
+				success = false
+			}
+		}
+		return success
+	}
+
+	fmt.Fprintf(out, "--- FAIL: %s: no configuration file defines the exporter '%s'\n", file, tests.Exporter)
+	return false
+}
+
+// runTestCommand runs every execution of the configured exporters once, without
+// starting any webserver, and prints the resulting metrics along with the details
+// of each execution.  It exits with an error code if any execution failed.
+// If test files are specified, the tests they define are run instead, and the
+// command exits with an error code if any test failed.
+func runTestCommand(args []string) {
+	var f = flag.NewFlagSet("test", flag.ExitOnError)
+
+	var listenAddress string
+	var webConfigFile string
+	var configFiles = arrayFlag{}
+	var testFiles = arrayFlag{}
+
+	addConfigFlags(f, &listenAddress, &webConfigFile, &configFiles)
+	f.Var(&testFiles, "t", "A file defining tests for one of the exporters.\n"+
+		"This flag can be used multiple times to include multiple files.")
+
+	f.Parse(args)
+
+	checkConfigFlags(f, configFiles)
+
+	config := configparser.Config{
+		MainListenAddress: listenAddress,
+		WebConfigFile:     webConfigFile,
+		ConfigFiles:       configFiles,
+	}
+
+	if err := config.ParseConfig(); err != nil {
+		log.Fatal("Error parsing configuration: ", err)
+	}
+
+	// The errors are part of the printed diagnostics
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	success := true
+	if len(testFiles) > 0 {
+		for _, file := range testFiles {
+			if !runTestsFile(os.Stdout, config, file) {
+				success = false
+			}
+		}
+	} else {
+		for _, exporterCfg := range config.Exporters {
+			if !testExporter(os.Stdout, exporterCfg) {
+				success = false
+			}
+		}
+	}
+
+	if !success {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+)
+
+type fileValidationOutput struct {
+	File  string `json:"file"`
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+type validationOutput struct {
+	Valid bool                   `json:"valid"`
+	Files []fileValidationOutput `json:"files"`
+}
+
+// runValidateCommand verifies the configuration files without starting
+// any exporter, and exits with an error code if any of them is invalid
+func runValidateCommand(args []string) {
+	var f = flag.NewFlagSet("validate", flag.ExitOnError)
+
+	var listenAddress string
+	var webConfigFile string
+	var configFiles = arrayFlag{}
+	var format string
+
+	addConfigFlags(f, &listenAddress, &webConfigFile, &configFiles)
+	f.StringVar(&format, "o", "text", "The output format of the result: text or json")
+
+	f.Parse(args)
+
+	checkConfigFlags(f, configFiles)
+
+	if format != "text" && format != "json" {
+		fmt.Fprintln(os.Stderr, "Invalid output format '"+format+"'. Supported values are: text or json")
+		os.Exit(2)
+	}
+
+	config := configparser.Config{
+		MainListenAddress: listenAddress,
+		WebConfigFile:     webConfigFile,
+		ConfigFiles:       configFiles,
+	}
+
+	output := validationOutput{Valid: true}
+	for _, result := range config.Validate() {
+		fileOutput := fileValidationOutput{File: result.File, Valid: result.Error == nil}
+		if result.Error != nil {
+			fileOutput.Error = result.Error.Error()
+			output.Valid = false
+		}
+		output.Files = append(output.Files, fileOutput)
+	}
+
+	if format == "json" {
+		data, _ := json.MarshalIndent(output, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, fileOutput := range output.Files {
+			if fileOutput.Valid {
+				fmt.Println(fileOutput.File + ": OK")
+			} else {
+				fmt.Println(fileOutput.File + ": ERROR: " + fileOutput.Error)
+			}
+		}
+	}
+
+	if !output.Valid {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,172 @@
+package webservers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// routeTable is an http.Handler whose routes can be modified while it is serving,
+// which allows to add, replace or remove exporters without restarting the webserver
+type routeTable struct {
+	mutex  sync.RWMutex
+	routes map[string]http.Handler
+	// Handles the requests which don't match any route
+	fallback http.Handler
+}
+
+func newRouteTable(fallback http.Handler) *routeTable {
+	return &routeTable{
+		routes:   map[string]http.Handler{},
+		fallback: fallback,
+	}
+}
+
+func (t *routeTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mutex.RLock()
+	handler, ok := t.routes[r.URL.Path]
+	if !ok {
+		handler = t.fallback
+	}
+	t.mutex.RUnlock()
+
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+func (t *routeTable) setRoute(endpoint string, handler http.Handler) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.routes[endpoint] = handler
+}
+
+func (t *routeTable) removeRoute(endpoint string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.routes, endpoint)
+}
+
+func (t *routeTable) setFallback(handler http.Handler) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.fallback = handler
+}
+
+func (t *routeTable) isEmpty() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return len(t.routes) == 0
+}
+
+// logWriter sends the messages of the exporter-toolkit to the standard logger
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Print(string(p))
+	return len(p), nil
+}
+
+var webLogger = kitlog.NewLogfmtLogger(logWriter{})
+
+// listener is a webserver serving all the exporters using the same address
+type listener struct {
+	// Either [host]:port or unix:<path>
+	address string
+	// Enables TLS and basic authentication, in the exporter-toolkit format
+	webConfigFile string
+	server        *http.Server
+	routes        *routeTable
+}
+
+func newListener(address string, webConfigFile string, fallback http.Handler) *listener {
+	routes := newRouteTable(fallback)
+	return &listener{
+		address:       address,
+		webConfigFile: webConfigFile,
+		routes:        routes,
+		server: &http.Server{
+			Addr:    address,
+			Handler: routes,
+		},
+	}
+}
+
+// bind binds the address of the listener, either a TCP address or a Unix socket
+func (l *listener) bind() (net.Listener, error) {
+	network, address := configparser.ListenNetwork(l.address)
+	if network == "unix" {
+		// Remove the socket left behind by a previous run which did not shut down
+		// cleanly, as it prevents binding the same path, but not the socket of a
+		// process which is still listening on it
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			conn, err := net.Dial(network, address)
+			if err == nil {
+				conn.Close()
+				return nil, errors.New("Address " + l.address + " is already in use by another process")
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				os.Remove(address)
+			}
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// listen binds the address of the listener then serves it in the background,
+// so that binding errors are reported to the caller
+func (l *listener) listen() error {
+	netListener, err := l.bind()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := l.serve(netListener); err != nil && err != http.ErrServerClosed {
+			log.Println("Error serving address", l.address, ":", err)
+		}
+	}()
+	return nil
+}
+
+// listenAndServe binds the address of the listener and serves it until it is shut down
+func (l *listener) listenAndServe() error {
+	netListener, err := l.bind()
+	if err != nil {
+		return err
+	}
+	return l.serve(netListener)
+}
+
+// serve serves the listener using TLS and basic authentication if they are
+// enabled by the web configuration file.  The web configuration file is read
+// again for each new connection, so certificates and users can be updated
+// without restarting the listener.
+func (l *listener) serve(netListener net.Listener) error {
+	return web.Serve(netListener, l.server, l.webConfigFile, kitlog.With(webLogger, "address", l.address))
+}
+
+// shutdown gracefully stops the listener, allowing a maximum
+// 5 seconds for the shutdown to complete
+func (l *listener) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return l.server.Shutdown(ctx)
+}
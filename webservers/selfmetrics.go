@@ -0,0 +1,25 @@
+package webservers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics about the custom-prometheus-exporter itself, which are
+// served by the main webserver
+var (
+	selfRegistry = prometheus.NewRegistry()
+
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "custom_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+
+	configReloadSuccessTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "custom_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+)
+
+func init() {
+	selfRegistry.MustRegister(configReloadSuccess, configReloadSuccessTime)
+}
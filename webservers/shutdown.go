@@ -0,0 +1,66 @@
+package webservers
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/metricscollector"
+)
+
+var (
+	// Set once Shutdown was called, protected by reloadMutex
+	shuttingDown bool
+	// Closed once Shutdown has completed
+	shutdownComplete chan struct{}
+	// The grace period of a Shutdown called before the webservers were created,
+	// which is done once they are.  Protected by reloadMutex.
+	pendingShutdown *time.Duration
+)
+
+// Shutdown gracefully stops every webserver.  The scrapes in progress are given
+// the grace period to complete, after which the commands still running are
+// terminated.  CreateListenAndServe returns once the shutdown is complete.
+func Shutdown(gracePeriod time.Duration) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if shuttingDown || pendingShutdown != nil {
+		return
+	}
+	if listeners == nil {
+		pendingShutdown = &gracePeriod
+		return
+	}
+	shuttingDown = true
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	// Do the shutdowns in parallel as they all wait for their scrapes in progress
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			// Decrement the counter when the goroutine completes.
+			defer wg.Done()
+
+			// Stops accepting new scrapes, then waits for the ones in progress
+			if err := l.server.Shutdown(ctx); err != nil {
+				log.Println("Scrapes still in progress on address", l.address, "after the grace period:", err)
+			}
+		}(l)
+	}
+	wg.Wait()
+
+	// Kill the commands of the scrapes which did not complete in time.  This also
+	// prevents any new command from starting.
+	terminated := metricscollector.TerminateCommands()
+
+	log.Printf("Shutdown complete in %v: stopped %d exporters and %d webservers, terminated %d commands still running",
+		time.Since(start).Round(time.Millisecond), len(exporters), len(listeners), terminated)
+
+	close(shutdownComplete)
+}
@@ -0,0 +1,157 @@
+//go:build !windows
+// +build !windows
+
+package webservers
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+	"gotest.tools/assert"
+)
+
+// runInSubprocess runs a test in a new process, as shutting down cannot be undone
+// and would prevent the other tests from running commands.  The test must succeed.
+func runInSubprocess(t *testing.T, testCode func()) {
+	subprocessEnvVarName := "RUN_IN_SUBPROCESS"
+	if os.Getenv(subprocessEnvVarName) == "1" {
+		testCode()
+		return
+	}
+
+	testBinary, err := os.Executable()
+	assert.NilError(t, err)
+
+	cmd := exec.Command(testBinary, "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), subprocessEnvVarName+"=1")
+	timer := time.AfterFunc(20*time.Second, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+
+	out, err := cmd.CombinedOutput()
+	assert.NilError(t, err, "Output: "+string(out))
+	assert.Assert(t, strings.Contains(string(out), "--- PASS: "+t.Name()), "Output: "+string(out))
+}
+
+// startServing runs CreateListenAndServe with an exporter on the main address using
+// the given commands, by endpoint.  The returned channel is closed once it returns.
+func startServing(t *testing.T, commands map[string]string) (string, chan struct{}) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	address := free.Addr().String()
+	free.Close()
+
+	config := configparser.Config{MainListenAddress: address}
+	for endpoint, command := range commands {
+		exporterCfg, err := config.ParseExporter([]byte(`
+name: ` + strings.TrimPrefix(endpoint, "/") + `
+endpoint: ` + endpoint + `
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: ` + command + `
+    timeout: 0
+`))
+		assert.NilError(t, err)
+		config.Exporters = append(config.Exporters, exporterCfg)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		CreateListenAndServe(config)
+		close(done)
+	}()
+	return address, done
+}
+
+func waitServing(t *testing.T, address string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if response, err := http.Get("http://" + address + "/"); err == nil {
+			response.Body.Close()
+			return
+		}
+		assert.Assert(t, time.Now().Before(deadline), "The main server is not serving")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitShutdown(t *testing.T, done chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("CreateListenAndServe did not return")
+	}
+}
+
+func TestShutdownDrainsScrapes(t *testing.T) {
+	runInSubprocess(t, func() {
+		logs := captureLogs(t)
+		pidFile := filepath.Join(t.TempDir(), "pid")
+		address, done := startServing(t, map[string]string{
+			"/fast": "sleep 0.5; echo 1",
+			// The process group of the command is killed, including its children
+			"/slow": "sleep 30 & echo $! > " + pidFile + "; wait",
+		})
+		waitServing(t, address)
+
+		fast := make(chan string)
+		go func() {
+			response, err := http.Get("http://" + address + "/fast")
+			assert.NilError(t, err)
+			body, _ := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			fast <- string(body)
+		}()
+		go http.Get("http://" + address + "/slow")
+		time.Sleep(200 * time.Millisecond)
+
+		start := time.Now()
+		go Shutdown(time.Second)
+
+		// The scrape completing within the grace period is served
+		body := <-fast
+		assert.Assert(t, strings.Contains(body, "test_value 1"), "Body: "+body)
+
+		// The commands still running after the grace period are killed
+		waitShutdown(t, done)
+		assert.Assert(t, time.Since(start) < 5*time.Second)
+		assert.Equal(t, logs.count("terminated 1 commands still running"), 1)
+		pid, err := ioutil.ReadFile(pidFile)
+		assert.NilError(t, err)
+		child, err := strconv.Atoi(strings.TrimSpace(string(pid)))
+		assert.NilError(t, err)
+		deadline := time.Now().Add(5 * time.Second)
+		for syscall.Kill(child, 0) == nil {
+			assert.Assert(t, time.Now().Before(deadline), "The child of the command is still running")
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// New scrapes are refused
+		_, err = http.Get("http://" + address + "/fast")
+		assert.Assert(t, err != nil)
+	})
+}
+
+func TestShutdownBeforeServing(t *testing.T) {
+	runInSubprocess(t, func() {
+		logs := captureLogs(t)
+		// A termination signal received while starting is not lost
+		Shutdown(time.Second)
+		_, done := startServing(t, map[string]string{"/exporter": "echo 1"})
+		waitShutdown(t, done)
+		assert.Equal(t, logs.count("Shutdown complete"), 1)
+	})
+}
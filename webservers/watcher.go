@@ -0,0 +1,101 @@
+package webservers
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// isConfigChange returns true if the event affects one of the configuration files
+func isConfigChange(event fsnotify.Event, files map[string]bool) bool {
+	// Only changing the permissions of a file does not affect its content
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+
+	if files[event.Name] {
+		return true
+	}
+
+	// Kubernetes updates mounted ConfigMaps by atomically replacing the
+	// '..data' symbolic link, which the configuration files point to
+	return strings.HasPrefix(filepath.Base(event.Name), "..")
+}
+
+// WatchConfigFiles reloads the configuration whenever one of the configuration files
+// changes.  Rapid changes are grouped together and the reload only happens once
+// no other change occurred for the debounce duration.
+func WatchConfigFiles(configFiles []string, debounce time.Duration) error {
+	_, err := watchConfigFiles(configFiles, debounce)
+	return err
+}
+
+// watchConfigFiles starts watching the configuration files, until the returned watcher is closed
+func watchConfigFiles(configFiles []string, debounce time.Duration) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are often replaced instead of modified (e.g., by editors or by Kubernetes),
+	// which a watch on the file itself does not survive; instead, the directories
+	// containing the files are watched.
+	files := map[string]bool{}
+	watched := map[string]bool{}
+	for _, file := range configFiles {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		files[path] = true
+
+		dir := filepath.Dir(path)
+		if !watched[dir] {
+			if err := watcher.Add(dir); err != nil {
+				watcher.Close()
+				return nil, err
+			}
+			watched[dir] = true
+		}
+	}
+
+	reloadOnChange := func() {
+		log.Println("Configuration files have changed, reloading configuration")
+		if _, err := Reload(); err != nil {
+			log.Println("Reload failed!", err)
+		}
+	}
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if !isConfigChange(event, files) {
+					continue
+				}
+
+				if timer == nil {
+					timer = time.AfterFunc(debounce, reloadOnChange)
+				} else {
+					timer.Reset(debounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("Error watching configuration files:", err)
+			}
+		}
+	}()
+
+	return watcher, nil
+}
@@ -0,0 +1,136 @@
+package webservers
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestIsConfigChange(t *testing.T) {
+	files := map[string]bool{"/etc/exporters/docker.yaml": true}
+
+	assert.Assert(t, isConfigChange(fsnotify.Event{Name: "/etc/exporters/docker.yaml", Op: fsnotify.Write}, files))
+	assert.Assert(t, isConfigChange(fsnotify.Event{Name: "/etc/exporters/docker.yaml", Op: fsnotify.Rename}, files))
+	assert.Assert(t, isConfigChange(fsnotify.Event{Name: "/etc/exporters/..data", Op: fsnotify.Create}, files))
+
+	assert.Assert(t, !isConfigChange(fsnotify.Event{Name: "/etc/exporters/docker.yaml", Op: fsnotify.Chmod}, files))
+	assert.Assert(t, !isConfigChange(fsnotify.Event{Name: "/etc/exporters/other.yaml", Op: fsnotify.Write}, files))
+	assert.Assert(t, !isConfigChange(fsnotify.Event{Name: "/etc/exporters/.docker.yaml.swp", Op: fsnotify.Write}, files))
+}
+
+// logBuffer collects the logs written concurrently by the tested code
+type logBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buffer.Write(p)
+}
+
+func (l *logBuffer) count(text string) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return strings.Count(l.buffer.String(), text)
+}
+
+func captureLogs(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return logs
+}
+
+func TestWatchConfigFilesDebounce(t *testing.T) {
+	exporter := func(command string) string {
+		return `
+name: exporter
+endpoint: /exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: ` + command + "\n"
+	}
+
+	dir := t.TempDir()
+	file := writeConfigFile(t, dir, "exporter.yaml", exporter("echo 1"))
+	setupMainListener()
+	configuration.ConfigFiles = []string{file}
+	_, err := Reload()
+	assert.NilError(t, err)
+
+	logs := captureLogs(t)
+	watcher, err := watchConfigFiles([]string{file}, 500*time.Millisecond)
+	assert.NilError(t, err)
+	defer watcher.Close()
+
+	// Rapid changes are grouped in a single reload, once they stopped
+	for _, command := range []string{"echo 2", "echo 3", "echo 4"} {
+		writeConfigFile(t, dir, "exporter.yaml", exporter(command))
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, logs.count("reloading configuration"), 0)
+	assert.Equal(t, configuration.Exporters[0].Metrics[0].Executions[0].Command, "echo 1")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for logs.count("Configuration reloaded") == 0 {
+		assert.Assert(t, time.Now().Before(deadline), "The configuration was not reloaded")
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, logs.count("reloading configuration"), 1)
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	assert.Equal(t, configuration.Exporters[0].Metrics[0].Executions[0].Command, "echo 4")
+}
+
+func TestReloadMetrics(t *testing.T) {
+	dir := t.TempDir()
+	valid := `
+name: exporter
+endpoint: /exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo 1
+`
+	file := writeConfigFile(t, dir, "exporter.yaml", valid)
+	setupMainListener()
+	configuration.ConfigFiles = []string{file}
+
+	before := time.Now().Unix()
+	_, err := Reload()
+	assert.NilError(t, err)
+	assert.Equal(t, testutil.ToFloat64(configReloadSuccess), float64(1))
+	successTime := testutil.ToFloat64(configReloadSuccessTime)
+	assert.Assert(t, successTime >= float64(before), successTime)
+
+	// A failed reload keeps the time of the last successful one
+	writeConfigFile(t, dir, "exporter.yaml", "name: exporter\n")
+	_, err = Reload()
+	assert.Assert(t, err != nil)
+	assert.Equal(t, testutil.ToFloat64(configReloadSuccess), float64(0))
+	assert.Equal(t, testutil.ToFloat64(configReloadSuccessTime), successTime)
+
+	writeConfigFile(t, dir, "exporter.yaml", valid)
+	_, err = Reload()
+	assert.NilError(t, err)
+	assert.Equal(t, testutil.ToFloat64(configReloadSuccess), float64(1))
+}
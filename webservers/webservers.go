@@ -2,9 +2,15 @@ package webservers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,12 +23,53 @@ import (
 const (
 	reloadEndpoint   string = "/-/reload"
 	validateEndpoint string = "/validate"
+	metricsEndpoint  string = "/-/metrics"
+
+	// The header by which Prometheus gives the timeout of its scrapes
+	scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+	// The longest scrape timeout, as larger values would overflow the deadline
+	maxScrapeTimeout = 24 * time.Hour
 )
 
 var (
 	configuration configparser.Config
-	mainServer    *http.Server
-	webServers    []*http.Server
+	// The running exporters, by name
+	exporters map[string]configparser.ExporterConfig
+	// The webservers, by address
+	listeners map[string]*listener
+
+	// Prevents concurrent reloads, which can be triggered by the reload
+	// endpoint, a SIGHUP or a change to the configuration files
+	reloadMutex sync.Mutex
+)
+
+// ReloadResult describes the outcome of a reload and lists the
+// names of the exporters affected by it
+type ReloadResult struct {
+	Status  string   `json:"status"`
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+	Errors  []string `json:"errors,omitempty"`
+	// Set if the new configuration could not be applied
+	// and the previous one was restored
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+const (
+	reloadSuccess = "success"
+	reloadFailure = "failure"
+)
+
+var (
+	// errInvalidConfiguration is returned by Reload when the new configuration
+	// is invalid, in which case it was not applied at all
+	errInvalidConfiguration = errors.New("Error parsing new configuration")
+	// errApplyConfiguration is returned by Reload when the new configuration
+	// could not be applied, in which case the previous one was restored
+	errApplyConfiguration = errors.New("Error applying new configuration")
+	// errShuttingDown is returned by Reload when the exporters are shutting down
+	errShuttingDown = errors.New("Shutting down")
 )
 
 func handleWrongReloadEndpoint(w http.ResponseWriter, r *http.Request) {
@@ -31,6 +78,8 @@ func handleWrongReloadEndpoint(w http.ResponseWriter, r *http.Request) {
 
 func handleReloadEndpoint(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		w.Write([]byte(`<html>
 				        <head><title>Custom Prometheus Exporter</title></head>
 					    <body>
@@ -46,26 +95,79 @@ func handleReloadEndpoint(w http.ResponseWriter, r *http.Request) {
 	// POST method requesting a reload
 
 	// Parse the new configuration, if it is not valid, ignore it and give an error message.
-	newConfig := configparser.Config{
-		MainPort:    configuration.MainPort,
-		ConfigFiles: configuration.ConfigFiles,
+	result, err := Reload()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, errInvalidConfiguration):
+		log.Println("Reload failed!", err)
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, errShuttingDown):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		log.Println("Reload failed!", err)
+		w.WriteHeader(http.StatusInternalServerError)
 	}
 
-	err := newConfig.ParseConfig()
-	if err != nil {
-		errorMsg := fmt.Sprint("Reload failed! Error parsing new configuration:\n\t", err)
-		log.Println(errorMsg)
+	data, _ := json.MarshalIndent(result, "", "  ")
+	w.Write(append(data, '\n'))
+}
 
-		w.Write([]byte(errorMsg))
-		return
+// Reload parses the configuration files again and, if the new configuration
+// is valid, applies it.  Only the exporters whose configuration changed are
+// restarted.  The current configuration is kept if the new one is not valid,
+// and is restored if the new one cannot be applied.
+func Reload() (ReloadResult, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	result := ReloadResult{Status: reloadFailure, Added: []string{}, Changed: []string{}, Removed: []string{}}
+	if shuttingDown {
+		result.Errors = []string{errShuttingDown.Error()}
+		return result, errShuttingDown
 	}
 
-	// New configuration is valid, stop the web servers and restart them
-	configuration = newConfig
+	newConfig := configparser.Config{
+		MainListenAddress:   configuration.MainListenAddress,
+		WebConfigFile:       configuration.WebConfigFile,
+		ScrapeTimeoutOffset: configuration.ScrapeTimeoutOffset,
+		ConfigFiles:         configuration.ConfigFiles,
+	}
 
-	if err = shutdownWebServers(); err != nil {
-		log.Fatal("Terminal error while stopping webservers for exporters: ", err)
+	for _, validation := range newConfig.Validate() {
+		if validation.Error != nil {
+			result.Errors = append(result.Errors, validation.File+": "+validation.Error.Error())
+		}
 	}
+	if len(result.Errors) > 0 {
+		configReloadSuccess.Set(0)
+		return result, fmt.Errorf("%w: %s", errInvalidConfiguration, strings.Join(result.Errors, ", "))
+	}
+
+	// New configuration is valid, apply the differences
+	previousConfig := configuration
+	result, err := applyConfiguration(newConfig)
+	if err != nil {
+		configReloadSuccess.Set(0)
+
+		// Go back to the previous configuration, which was working
+		if _, rollbackErr := applyConfiguration(previousConfig); rollbackErr != nil {
+			log.Println("Error restoring the previous configuration:", rollbackErr)
+			result.Errors = append(result.Errors, "Error restoring the previous configuration: "+rollbackErr.Error())
+		} else {
+			result.RolledBack = true
+		}
+		return result, fmt.Errorf("%w: %s", errApplyConfiguration, strings.Join(result.Errors, ", "))
+	}
+
+	log.Println("Configuration reloaded. Added exporters:", result.Added,
+		"Changed exporters:", result.Changed, "Removed exporters:", result.Removed)
+
+	configReloadSuccess.Set(1)
+	configReloadSuccessTime.SetToCurrentTime()
+	return result, nil
 }
 
 func handleMainRootEndpoint(w http.ResponseWriter, r *http.Request) {
@@ -79,6 +181,7 @@ func handleMainRootEndpoint(w http.ResponseWriter, r *http.Request) {
 	        <ul>
 	            <li><a href=/validate>/validate</a> - Validate if modifications to the configuration files are valid.
 	            <li><a href=/-/reload>/-/reload</a> - POST only. Reload the configuration files (assuming they have changed) and restart all exporters
+	            <li><a href=/-/metrics>/-/metrics</a> - Metrics about the Custom Prometheus Exporter itself
 	        </ul>
 	    </body>
 	    </html>
@@ -88,7 +191,16 @@ func handleMainRootEndpoint(w http.ResponseWriter, r *http.Request) {
 func handleValidateEndpoint(w http.ResponseWriter, r *http.Request) {
 	// Parse the new configuration and let the user know if it is valid.
 	log.Println(validateEndpoint, "has been called")
-	newConfig := configparser.Config{ConfigFiles: configuration.ConfigFiles}
+
+	// The configuration is replaced by the reloads
+	reloadMutex.Lock()
+	newConfig := configparser.Config{
+		MainListenAddress:   configuration.MainListenAddress,
+		WebConfigFile:       configuration.WebConfigFile,
+		ScrapeTimeoutOffset: configuration.ScrapeTimeoutOffset,
+		ConfigFiles:         configuration.ConfigFiles,
+	}
+	reloadMutex.Unlock()
 
 	var msg string
 	err := newConfig.ParseConfig()
@@ -124,139 +236,290 @@ func handleExporterRootEndpoint(name string, endpoint string) func(http.Response
 	}
 }
 
-// CreateExporters instantiates each exporter as requested
-// in the configuration
-func createExporters() {
-	webServers = make([]*http.Server, 0, len(configuration.Exporters))
+// The query parameters selecting the metrics of a scrape
+var metricSelectionParams = []string{"collect[]", "name[]"}
+
+// exporterHandler serves the metrics of an exporter, interrupting the
+// executions once the scrape timeout given by the scraper expires
+type exporterHandler struct {
+	collector     *metricscollector.MetricsCollector
+	opts          promhttp.HandlerOpts
+	timeoutOffset time.Duration
+	// The names of the metrics of the exporter, which a scrape can select
+	metricNames map[string]bool
+	// Set if the exporter is a probe, whose collector is created for each scrape
+	probe *configparser.ExporterConfig
+}
 
-	for _, exporterCfg := range configuration.Exporters {
-		metricsCollector := metricscollector.MetricsCollector{}
-		metricsCollector.AddMetrics(exporterCfg.Metrics)
+// newExporterHandler instantiates an exporter and returns the handler serving its metrics
+func newExporterHandler(exporterCfg configparser.ExporterConfig) http.Handler {
+	metricsCollector := metricscollector.MetricsCollector{}
+	metricsCollector.AddMetrics(exporterCfg.Metrics)
+	metricsCollector.SetMinInterval(time.Duration(exporterCfg.MinInterval) * time.Millisecond)
 
-		// Don't use the default registry to avoid getting the go collector
-		// and all its metrics
-		registry := prometheus.NewRegistry()
-		registry.MustRegister(&metricsCollector)
-		handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	metricNames := map[string]bool{}
+	for _, metric := range exporterCfg.Metrics {
+		metricNames[metric.Name] = true
+	}
 
-		createExporterWebserver(&handler, exporterCfg)
+	handler := &exporterHandler{
+		collector: &metricsCollector,
+		opts: promhttp.HandlerOpts{
+			// The response is compressed when the scraper accepts it
+			EnableOpenMetrics:                   *exporterCfg.OpenMetrics,
+			EnableOpenMetricsTextCreatedSamples: exporterCfg.CreatedTimestamps,
+		},
+		timeoutOffset: configuration.ScrapeTimeoutOffset,
+		metricNames:   metricNames,
+	}
+	if exporterCfg.Probe != nil {
+		handler.probe = &exporterCfg
 	}
+	return handler
 }
 
-func createMainServer() {
-	// Setup main server
-	server := http.NewServeMux()
+// selectedMetrics returns the metrics selected by the query parameters of a scrape,
+// or nil if the scrape does not select any metric, in which case all of them are collected
+func (h *exporterHandler) selectedMetrics(r *http.Request) ([]string, error) {
+	var selected []string
+	query := r.URL.Query()
+	for _, param := range metricSelectionParams {
+		for _, name := range query[param] {
+			if !h.metricNames[name] {
+				return nil, errors.New("Unknown metric '" + name + "' in query parameter '" + param + "'")
+			}
+			selected = append(selected, name)
+		}
+	}
+	return selected, nil
+}
 
-	server.HandleFunc("/", handleMainRootEndpoint)
-	server.HandleFunc("/reload", handleWrongReloadEndpoint)
-	server.HandleFunc(reloadEndpoint, handleReloadEndpoint)
-	server.HandleFunc(validateEndpoint, handleValidateEndpoint)
+// probeCollector returns a collector running the commands of a probe
+// against the target and parameters given by a scrape
+func (h *exporterHandler) probeCollector(r *http.Request) (*metricscollector.MetricsCollector, error) {
+	query := r.URL.Query()
+	params := map[string]string{}
+	for _, name := range h.probe.Probe.Params {
+		params[name] = query.Get(name)
+	}
 
-	mainServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", configuration.MainPort),
-		Handler: server,
+	metrics, err := h.probe.ProbeMetrics(query.Get("target"), params)
+	if err != nil {
+		return nil, err
 	}
+
+	collector := &metricscollector.MetricsCollector{}
+	collector.AddMetrics(metrics)
+	return collector, nil
 }
 
-// CreateExporterWebserver -
-func createExporterWebserver(handler *http.Handler, exporterCfg configparser.ExporterConfig) {
-	if exporterCfg.Port == configuration.MainPort {
-		// The exporter should re-use the main port
-		server := mainServer.Handler.(*http.ServeMux)
-		server.Handle(fmt.Sprintf("%s", exporterCfg.Endpoint), *handler)
-		log.Println(exporterCfg.Name, "listening on port", configuration.MainPort, "and endpoint", exporterCfg.Endpoint)
-	} else {
-		// Need to call serveMux to be able to run multiple servers at the same time
-		server := http.NewServeMux()
-		// Handle the endpoint serving the metrics
-		server.Handle(fmt.Sprintf("%s", exporterCfg.Endpoint), *handler)
-		// Give some info on the root endpoint
-		server.HandleFunc("/", handleExporterRootEndpoint(exporterCfg.Name, exporterCfg.Endpoint))
+func (h *exporterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	selected, err := h.selectedMetrics(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The executions are also interrupted if the scraper goes away
+	ctx := r.Context()
+	timeout, err := strconv.ParseFloat(r.Header.Get(scrapeTimeoutHeader), 64)
+	if err == nil && timeout > 0 && !math.IsInf(timeout, 0) && !math.IsNaN(timeout) {
+		deadline := maxScrapeTimeout
+		if timeout < maxScrapeTimeout.Seconds() {
+			deadline = time.Duration(timeout * float64(time.Second))
+		}
+		if deadline > h.timeoutOffset {
+			deadline -= h.timeoutOffset
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
 
-		// Create a server object which we can later Shutdown()
-		newWebServer := &http.Server{
-			Addr:    fmt.Sprintf(":%d", exporterCfg.Port),
-			Handler: server,
+	collector := h.collector
+	if h.probe != nil {
+		// The values of a probe only concern the target of the scrape
+		if collector, err = h.probeCollector(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		webServers = append(webServers, newWebServer)
-		log.Println(exporterCfg.Name, "listening on port", exporterCfg.Port, "and endpoint", exporterCfg.Endpoint)
 	}
+
+	// Don't use the default registry to avoid getting the go collector
+	// and all its metrics.  A registry is created for each scrape to give
+	// the context of the scrape to the collector.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector.ScrapeCollector(ctx, selected))
+	promhttp.HandlerFor(registry, h.opts).ServeHTTP(w, r)
 }
 
-// CreateListenAndServe creates then starts all webservers
-// and blocks on the main one.
-func CreateListenAndServe(config configparser.Config) {
-	configuration = config
-
-	// Infinite loop which allows us to shutdown all servers and re-create them
-	// to support the reload functionality
-	for {
-		createMainServer()
-		createExporters()
-
-		for _, w := range webServers {
-			// Use go routine so as to not block, since we run multiple servers.
-			webServer := w
-			go func() {
-				webServer.ListenAndServe()
-			}()
+// applyConfiguration compares a new configuration to the current one and only
+// adds, replaces or removes the exporters which differ.  The exporters which did
+// not change keep running untouched.
+func applyConfiguration(newConfig configparser.Config) (ReloadResult, error) {
+	result := ReloadResult{Status: reloadSuccess, Added: []string{}, Changed: []string{}, Removed: []string{}}
+
+	newExporters := map[string]configparser.ExporterConfig{}
+	for _, exporterCfg := range newConfig.Exporters {
+		newExporters[exporterCfg.Name] = exporterCfg
+	}
+
+	// First remove the exporters which are gone, or which moved to
+	// another address or changed web configuration, to free their address
+	for name, current := range exporters {
+		newCfg, found := newExporters[name]
+		switch {
+		case !found:
+			result.Removed = append(result.Removed, name)
+			removeExporter(current)
+		case reflect.DeepEqual(current, newCfg):
+			continue
+		default:
+			result.Changed = append(result.Changed, name)
+			if newCfg.ListenAddress != current.ListenAddress || newCfg.WebConfigFile != current.WebConfigFile {
+				removeExporter(current)
+			}
+		}
+	}
+
+	for _, exporterCfg := range newConfig.Exporters {
+		current, found := exporters[exporterCfg.Name]
+		if found && reflect.DeepEqual(current, exporterCfg) {
+			continue
+		}
+
+		if !contains(result.Changed, exporterCfg.Name) {
+			result.Added = append(result.Added, exporterCfg.Name)
+		}
+
+		// A changed exporter which stays on the same address is replaced in place,
+		// without interrupting the webserver of that address
+		if found && current.ListenAddress == exporterCfg.ListenAddress &&
+			current.WebConfigFile == exporterCfg.WebConfigFile && current.Endpoint != exporterCfg.Endpoint {
+			listeners[current.ListenAddress].routes.removeRoute(current.Endpoint)
 		}
 
-		log.Println("Main server listening on port", configuration.MainPort)
-		// Block on the main server
-		mainServer.ListenAndServe()
+		if err := addExporter(exporterCfg); err != nil {
+			log.Println("Error starting exporter", exporterCfg.Name, ":", err)
+			result.Errors = append(result.Errors, "Error starting exporter "+exporterCfg.Name+": "+err.Error())
+		}
+	}
 
-		log.Println("Main server has shutdown")
+	configuration = newConfig
+	if len(result.Errors) > 0 {
+		result.Status = reloadFailure
+		return result, errors.New(strings.Join(result.Errors, ", "))
 	}
+	return result, nil
 }
 
-// ShutdownWebServers gracefully shutsdown every exporter, allowing a maximum
-// 5 seconds for the shutdown to complete
-func shutdownWebServers() error {
-	// Do the shutdowns in parallel for efficiency
-	var wg sync.WaitGroup
-	var shutdownErr error
-
-	for _, s := range webServers {
-		server := s
-		if server != nil {
-			wg.Add(1)
-			go func() {
-				// Decrement the counter when the goroutine completes.
-				defer wg.Done()
-
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-
-				log.Println("About to shutdown exporter server")
-
-				if err := server.Shutdown(ctx); err != nil {
-					shutdownErr = err
-				}
-				log.Println("Exporter server has shutdown")
-			}()
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
 	}
-	// Wait for all shutdowns to complete
-	wg.Wait()
+	return false
+}
 
-	if shutdownErr != nil {
-		log.Println("Shutdown error for exporter server", shutdownErr)
-		return shutdownErr
+// addExporter serves a new exporter, starting a webserver for its address if needed
+func addExporter(exporterCfg configparser.ExporterConfig) error {
+	l, found := listeners[exporterCfg.ListenAddress]
+	if !found {
+		l = newListener(exporterCfg.ListenAddress, exporterCfg.WebConfigFile, nil)
+		if err := l.listen(); err != nil {
+			return err
+		}
+		listeners[exporterCfg.ListenAddress] = l
 	}
 
-	// Now shutdown the main server
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	if exporterCfg.ListenAddress != configuration.MainListenAddress {
+		// Give some info on the root endpoint
+		l.routes.setFallback(http.HandlerFunc(handleExporterRootEndpoint(exporterCfg.Name, exporterCfg.Endpoint)))
+	}
 
-	log.Println("About to shutdown main server")
+	// Handle the endpoint serving the metrics
+	l.routes.setRoute(exporterCfg.Endpoint, newExporterHandler(exporterCfg))
+	exporters[exporterCfg.Name] = exporterCfg
 
-	if err := mainServer.Shutdown(ctx); err != nil {
-		log.Println("Shutdown error for main server", err)
-		// Ignore Error.  We keep getting one but if we ignore things still work...
-		log.Println("Ignoring error and continuing")
-		// return err
+	log.Println(exporterCfg.Name, "listening on address", exporterCfg.ListenAddress, "and endpoint", exporterCfg.Endpoint)
+	return nil
+}
+
+// removeExporter stops serving an exporter, and stops the webserver
+// of its address if no other exporter uses it
+func removeExporter(exporterCfg configparser.ExporterConfig) {
+	delete(exporters, exporterCfg.Name)
+
+	l, found := listeners[exporterCfg.ListenAddress]
+	if !found {
+		return
 	}
+	l.routes.removeRoute(exporterCfg.Endpoint)
+	log.Println(exporterCfg.Name, "no longer listening on address", exporterCfg.ListenAddress, "and endpoint", exporterCfg.Endpoint)
 
-	return nil
+	if l.address != configuration.MainListenAddress && l.routes.isEmpty() {
+		delete(listeners, l.address)
+		if err := l.shutdown(); err != nil {
+			log.Println("Shutdown error for exporter server", err)
+		}
+	}
+}
+
+func createMainServer(address string, webConfigFile string) *listener {
+	// Setup main server
+	server := http.NewServeMux()
+
+	server.HandleFunc("/", handleMainRootEndpoint)
+	server.HandleFunc("/reload", handleWrongReloadEndpoint)
+	server.HandleFunc(reloadEndpoint, handleReloadEndpoint)
+	server.HandleFunc(validateEndpoint, handleValidateEndpoint)
+	server.Handle(metricsEndpoint, promhttp.HandlerFor(selfRegistry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+
+	// The exporters using the main address are routed before the main endpoints
+	return newListener(address, webConfigFile, server)
+}
+
+// CreateListenAndServe creates then starts all webservers
+// and blocks until Shutdown is called.
+func CreateListenAndServe(config configparser.Config) {
+	reloadMutex.Lock()
+	configuration = configparser.Config{
+		MainListenAddress:   config.MainListenAddress,
+		WebConfigFile:       config.WebConfigFile,
+		ScrapeTimeoutOffset: config.ScrapeTimeoutOffset,
+		ConfigFiles:         config.ConfigFiles,
+	}
+	exporters = map[string]configparser.ExporterConfig{}
+	listeners = map[string]*listener{}
+	shutdownComplete = make(chan struct{})
+
+	mainServer := createMainServer(config.MainListenAddress, config.WebConfigFile)
+	listeners[config.MainListenAddress] = mainServer
+
+	if _, err := applyConfiguration(config); err != nil {
+		log.Fatal("Error starting exporters: ", err)
+	}
+	pending := pendingShutdown
+	pendingShutdown = nil
+	reloadMutex.Unlock()
+
+	// A termination signal may have been received while starting
+	if pending != nil {
+		go Shutdown(*pending)
+	}
+
+	configReloadSuccess.Set(1)
+	configReloadSuccessTime.SetToCurrentTime()
+
+	log.Println("Main server listening on address", config.MainListenAddress)
+	// Block on the main server
+	if err := mainServer.listenAndServe(); err != http.ErrServerClosed {
+		log.Fatal("Error serving main address: ", err)
+	}
+
+	// The main server stops as soon as the shutdown starts
+	<-shutdownComplete
+	log.Println("Main server has shutdown")
 }
@@ -0,0 +1,495 @@
+package webservers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marckhouzam/custom-prometheus-exporter/configparser"
+	"gotest.tools/assert"
+)
+
+const testMainAddress = ":9530"
+
+func exporterConfig(t *testing.T, name string, endpoint string, command string) configparser.ExporterConfig {
+	data := `
+name: ` + name + `
+endpoint: ` + endpoint + `
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: ` + command
+
+	config := configparser.Config{MainListenAddress: testMainAddress}
+	exporterCfg, err := config.ParseExporter([]byte(data))
+	assert.NilError(t, err)
+	return exporterCfg
+}
+
+// setupMainListener prepares the main webserver, without binding its address
+func setupMainListener() *listener {
+	configuration = configparser.Config{MainListenAddress: testMainAddress}
+	exporters = map[string]configparser.ExporterConfig{}
+	listeners = map[string]*listener{}
+
+	mainListener := createMainServer(testMainAddress, "")
+	listeners[testMainAddress] = mainListener
+	return mainListener
+}
+
+func handlerPointer(l *listener, endpoint string) uintptr {
+	return reflect.ValueOf(l.routes.routes[endpoint]).Pointer()
+}
+
+func TestApplyConfigurationOnlyChangesDifferences(t *testing.T) {
+	mainListener := setupMainListener()
+
+	_, err := applyConfiguration(configparser.Config{MainListenAddress: testMainAddress, Exporters: []configparser.ExporterConfig{
+		exporterConfig(t, "unchanged", "/unchanged", "echo 1"),
+		exporterConfig(t, "changed", "/changed", "echo 2"),
+		exporterConfig(t, "removed", "/removed", "echo 3"),
+	}})
+	assert.NilError(t, err)
+	unchangedHandler := handlerPointer(mainListener, "/unchanged")
+
+	result, err := applyConfiguration(configparser.Config{MainListenAddress: testMainAddress, Exporters: []configparser.ExporterConfig{
+		exporterConfig(t, "unchanged", "/unchanged", "echo 1"),
+		exporterConfig(t, "changed", "/changed-endpoint", "echo 22"),
+		exporterConfig(t, "added", "/added", "echo 4"),
+	}})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, result, ReloadResult{
+		Status:  reloadSuccess,
+		Added:   []string{"added"},
+		Changed: []string{"changed"},
+		Removed: []string{"removed"},
+	})
+
+	// The unchanged exporter must keep its handler, and thus its registry
+	assert.Equal(t, handlerPointer(mainListener, "/unchanged"), unchangedHandler)
+
+	routes := mainListener.routes.routes
+	assert.Equal(t, len(routes), 3)
+	for _, endpoint := range []string{"/unchanged", "/changed-endpoint", "/added"} {
+		_, found := routes[endpoint]
+		assert.Assert(t, found, "Missing route "+endpoint)
+	}
+}
+
+func TestRouteTableFallback(t *testing.T) {
+	mainListener := setupMainListener()
+	_, err := applyConfiguration(configparser.Config{MainListenAddress: testMainAddress, Exporters: []configparser.ExporterConfig{
+		exporterConfig(t, "exporter", "/exporter", "echo 1"),
+	}})
+	assert.NilError(t, err)
+
+	recorder := httptest.NewRecorder()
+	mainListener.routes.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/exporter", nil))
+	assert.Assert(t, strings.Contains(recorder.Body.String(), "test_value 1"), "Body: "+recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	mainListener.routes.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Assert(t, strings.Contains(recorder.Body.String(), "Available main endpoints"), "Body: "+recorder.Body.String())
+}
+
+func writeConfigFile(t *testing.T, dir string, name string, data string) string {
+	file := filepath.Join(dir, name)
+	assert.NilError(t, ioutil.WriteFile(file, []byte(data), 0644))
+	return file
+}
+
+func TestReloadInvalidConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	file := writeConfigFile(t, dir, "exporter.yaml", `
+name: exporter
+endpoint: /exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo 1
+`)
+	setupMainListener()
+	configuration.ConfigFiles = []string{file}
+
+	writeConfigFile(t, dir, "exporter.yaml", "name: exporter\n")
+
+	recorder := httptest.NewRecorder()
+	handleReloadEndpoint(recorder, httptest.NewRequest(http.MethodPost, reloadEndpoint, nil))
+
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+	var result ReloadResult
+	assert.NilError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	assert.Equal(t, result.Status, reloadFailure)
+	assert.Equal(t, len(result.Errors), 1)
+	assert.Assert(t, strings.Contains(result.Errors[0], "Missing field 'metrics' in top configuration"), result.Errors[0])
+}
+
+func TestReloadRollbackWhenPortIsUsed(t *testing.T) {
+	// Occupy a port so that the new configuration cannot be applied
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer busy.Close()
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+
+	dir := t.TempDir()
+	file := writeConfigFile(t, dir, "exporter.yaml", `
+name: exporter
+endpoint: /exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo 1
+`)
+	mainListener := setupMainListener()
+	configuration.ConfigFiles = []string{file}
+	_, err = Reload()
+	assert.NilError(t, err)
+
+	writeConfigFile(t, dir, "exporter.yaml", `
+name: exporter
+port: `+strconv.Itoa(busyPort)+`
+endpoint: /exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo 1
+`)
+
+	recorder := httptest.NewRecorder()
+	handleReloadEndpoint(recorder, httptest.NewRequest(http.MethodPost, reloadEndpoint, nil))
+
+	assert.Equal(t, recorder.Code, http.StatusInternalServerError)
+	var result ReloadResult
+	assert.NilError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	assert.Equal(t, result.Status, reloadFailure)
+	assert.Assert(t, result.RolledBack)
+	assert.DeepEqual(t, result.Changed, []string{"exporter"})
+
+	// The previous configuration is back in place
+	assert.Equal(t, configuration.Exporters[0].ListenAddress, testMainAddress)
+	_, found := mainListener.routes.routes["/exporter"]
+	assert.Assert(t, found)
+}
+
+func TestValidateEndpointDuringReload(t *testing.T) {
+	file := writeConfigFile(t, t.TempDir(), "exporter.yaml", `
+name: exporter
+endpoint: /exporter
+metrics:
+- name: test_value
+  help: Some value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo 1
+`)
+	setupMainListener()
+	configuration.ConfigFiles = []string{file}
+
+	// The configuration is not read while a reload replaces it
+	reloadMutex.Lock()
+	recorder := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handleValidateEndpoint(recorder, httptest.NewRequest(http.MethodGet, validateEndpoint, nil))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("The configuration was validated during a reload")
+	case <-time.After(100 * time.Millisecond):
+	}
+	reloadMutex.Unlock()
+
+	<-done
+	assert.Assert(t, strings.Contains(recorder.Body.String(), "Configuration is valid"), "Body: "+recorder.Body.String())
+}
+
+func TestReloadRequiresPost(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handleReloadEndpoint(recorder, httptest.NewRequest(http.MethodGet, reloadEndpoint, nil))
+	assert.Equal(t, recorder.Code, http.StatusMethodNotAllowed)
+}
+
+func TestListenerBasicAuthentication(t *testing.T) {
+	l := newListener("127.0.0.1:0", "../example-configurations/web-config.yaml", nil)
+	l.routes.setRoute("/metrics", newExporterHandler(exporterConfig(t, "exporter", "/metrics", "echo 1")))
+
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go l.serve(netListener)
+	defer l.shutdown()
+
+	url := "http://" + netListener.Addr().String() + "/metrics"
+	response, err := http.Get(url)
+	assert.NilError(t, err)
+	response.Body.Close()
+	assert.Equal(t, response.StatusCode, http.StatusUnauthorized)
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	assert.NilError(t, err)
+	request.SetBasicAuth("prometheus", "secret")
+	response, err = http.DefaultClient.Do(request)
+	assert.NilError(t, err)
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, response.StatusCode, http.StatusOK)
+	assert.Assert(t, strings.Contains(string(body), "test_value 1"), "Body: "+string(body))
+}
+
+func TestListenerUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "exporter.sock")
+	l := newListener("unix:"+socket, "", nil)
+	l.routes.setRoute("/metrics", newExporterHandler(exporterConfig(t, "exporter", "/metrics", "echo 1")))
+
+	assert.NilError(t, l.listen())
+	defer l.shutdown()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	response, err := client.Get("http://exporter/metrics")
+	assert.NilError(t, err)
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Assert(t, strings.Contains(string(body), "test_value 1"), "Body: "+string(body))
+}
+
+func TestListenerUnixSocketInUse(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "exporter.sock")
+
+	// The socket left behind by a process which did not shut down cleanly is replaced
+	stale, err := net.Listen("unix", socket)
+	assert.NilError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l := newListener("unix:"+socket, "", nil)
+	assert.NilError(t, l.listen())
+	defer l.shutdown()
+
+	// The socket of a listening process is not taken over
+	_, err = newListener("unix:"+socket, "", nil).bind()
+	assert.ErrorContains(t, err, "Address unix:"+socket+" is already in use")
+	conn, err := net.Dial("unix", socket)
+	assert.NilError(t, err)
+	conn.Close()
+}
+
+func TestExporterHandlerOpenMetrics(t *testing.T) {
+	config := configparser.Config{MainListenAddress: testMainAddress}
+	exporterCfg, err := config.ParseExporter([]byte(`
+name: exporter
+createdTimestamps: true
+metrics:
+- name: test_total
+  help: Some total
+  type: counter
+  executions:
+  - type: sh
+    command: echo 5
+`))
+	assert.NilError(t, err)
+	handler := newExporterHandler(exporterCfg)
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	body := recorder.Body.String()
+	assert.Assert(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/openmetrics-text"))
+	assert.Assert(t, strings.Contains(body, "test_total 5.0\n"), "Body: "+body)
+	assert.Assert(t, strings.Contains(body, "test_created "), "Body: "+body)
+	assert.Assert(t, strings.HasSuffix(body, "# EOF\n"), "Body: "+body)
+
+	// The Prometheus text format is still served by default, compressed if accepted
+	request = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	assert.Assert(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"))
+	assert.Equal(t, recorder.Header().Get("Content-Encoding"), "gzip")
+}
+
+func TestExporterHandlerScrapeTimeout(t *testing.T) {
+	config := configparser.Config{MainListenAddress: testMainAddress}
+	exporterCfg, err := config.ParseExporter([]byte(`
+name: exporter
+metrics:
+- name: slow_value
+  help: Some slow value
+  type: gauge
+  executions:
+  - type: sh
+    command: sleep 10; echo 1
+    timeout: 0
+- name: fast_value
+  help: Some fast value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo 2
+`))
+	assert.NilError(t, err)
+	configuration = configparser.Config{ScrapeTimeoutOffset: 200 * time.Millisecond}
+	handler := newExporterHandler(exporterCfg)
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set(scrapeTimeoutHeader, "0.5")
+	recorder := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(recorder, request)
+
+	assert.Assert(t, time.Since(start) < 5*time.Second, "The scrape was not interrupted")
+	body := recorder.Body.String()
+	assert.Assert(t, strings.Contains(body, "custom_exporter_scrape_truncated 1"), "Body: "+body)
+	assert.Assert(t, !strings.Contains(body, "fast_value 2"), "Body: "+body)
+
+	// Without the header, or with a timeout which is not a duration, the scrape is not interrupted
+	for _, timeout := range []string{"", "Inf", "NaN", "-1", "1e300"} {
+		request = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set(scrapeTimeoutHeader, timeout)
+		recorder = httptest.NewRecorder()
+		newExporterHandler(exporterConfig(t, "exporter", "/metrics", "echo 1")).ServeHTTP(recorder, request)
+		body = recorder.Body.String()
+		assert.Assert(t, strings.Contains(body, "custom_exporter_scrape_truncated 0"), "Timeout: "+timeout+", body: "+body)
+		assert.Assert(t, strings.Contains(body, "test_value 1"), "Timeout: "+timeout+", body: "+body)
+	}
+}
+
+func TestExporterHandlerSelectsMetrics(t *testing.T) {
+	config := configparser.Config{MainListenAddress: testMainAddress}
+	exporterCfg, err := config.ParseExporter([]byte(`
+name: exporter
+metrics:
+- name: cheap_value
+  help: Some cheap value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo 1
+- name: expensive_value
+  help: Some expensive value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo 2
+`))
+	assert.NilError(t, err)
+	handler := newExporterHandler(exporterCfg)
+
+	scrape := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		return recorder
+	}
+
+	body := scrape("/metrics?collect[]=cheap_value").Body.String()
+	assert.Assert(t, strings.Contains(body, "cheap_value 1"), "Body: "+body)
+	assert.Assert(t, !strings.Contains(body, "expensive_value"), "Body: "+body)
+
+	body = scrape("/metrics?name[]=expensive_value").Body.String()
+	assert.Assert(t, strings.Contains(body, "expensive_value 2"), "Body: "+body)
+	assert.Assert(t, !strings.Contains(body, "cheap_value"), "Body: "+body)
+
+	body = scrape("/metrics").Body.String()
+	assert.Assert(t, strings.Contains(body, "cheap_value 1"), "Body: "+body)
+	assert.Assert(t, strings.Contains(body, "expensive_value 2"), "Body: "+body)
+
+	recorder := scrape("/metrics?collect[]=unknown_value")
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+}
+
+func TestExporterHandlerProbe(t *testing.T) {
+	config := configparser.Config{MainListenAddress: testMainAddress}
+	exporterCfg, err := config.ParseExporter([]byte(`
+name: probe
+probe:
+  params:
+  - suffix
+metrics:
+- name: probed_value
+  help: Some probed value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo {{ .Target }}{{ .Params.suffix }}
+`))
+	assert.NilError(t, err)
+	handler := newExporterHandler(exporterCfg)
+
+	scrape := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		return recorder
+	}
+
+	body := scrape("/metrics?target=4&suffix=2").Body.String()
+	assert.Assert(t, strings.Contains(body, "probed_value 42"), "Body: "+body)
+
+	// The values of a previous target are not kept
+	body = scrape("/metrics?target=7").Body.String()
+	assert.Assert(t, strings.Contains(body, "probed_value 7"), "Body: "+body)
+	assert.Assert(t, !strings.Contains(body, "probed_value 42"), "Body: "+body)
+
+	// The target is substituted as a single argument
+	body = scrape("/metrics?target=" + url.QueryEscape("1; echo 2")).Body.String()
+	assert.Assert(t, !strings.Contains(body, "probed_value 2"), "Body: "+body)
+
+	recorder := scrape("/metrics")
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+}
+
+func TestExporterHandlerProbeInvalidUTF8(t *testing.T) {
+	config := configparser.Config{MainListenAddress: testMainAddress}
+	exporterCfg, err := config.ParseExporter([]byte(`
+name: probe
+probe: {}
+metrics:
+- name: probed_value
+  help: Some probed value
+  type: gauge
+  executions:
+  - type: sh
+    command: echo 1
+    labels:
+      target: '{{ .Target }}'
+`))
+	assert.NilError(t, err)
+	handler := newExporterHandler(exporterCfg)
+
+	// The target would be a label value which is not valid UTF-8
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics?target=%ff", nil))
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+	assert.Assert(t, strings.Contains(recorder.Body.String(), "Invalid value for query parameter 'target'"),
+		"Body: "+recorder.Body.String())
+}